@@ -0,0 +1,67 @@
+package cleo
+
+import (
+	"net/http"
+	"time"
+)
+
+//AccessLog, when set, gets one key=value line per request to the cleo
+//endpoints, with its status, latency, and how many results it sent.
+//Set it before serving.
+var AccessLog Logger
+
+//accessLog logs each request to h on AccessLog.
+func accessLog(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := AccessLog
+		if logger == nil {
+			h(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK, results: -1}
+		h(rec, r)
+		logger.Printf("method=%s path=%s query=%q status=%d duration=%v results=%d truncated=%v",
+			r.Method, r.URL.Path, r.FormValue("query"), rec.status, time.Since(start), rec.results, rec.truncated)
+	}
+}
+
+//accessRecorder captures what accessLog reports about a response.
+type accessRecorder struct {
+	http.ResponseWriter
+	status    int
+	results   int //-1 when the handler does not return results
+	truncated bool
+}
+
+func (a *accessRecorder) WriteHeader(status int) {
+	a.status = status
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *accessRecorder) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (a *accessRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+//noteResults records for the access log that the response carries n
+//results, and whether paging cut some off.
+func noteResults(w http.ResponseWriter, n int, truncated bool) {
+	for {
+		switch rw := w.(type) {
+		case *accessRecorder:
+			rw.results, rw.truncated = n, truncated
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package cleo
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+//requireAdmin is requireAuth for endpoints that change the index.
+//They stay closed until ValidateToken is set.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	h = requireAuth(rateLimit(h))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ValidateToken == nil {
+			writeError(w, http.StatusForbidden, "admin endpoints require ValidateToken to be set")
+			return
+		}
+		h(w, r)
+	}
+}
+
+//docsHandler adds the words of a JSON array POSTed to the docs
+//endpoint, and deletes {word} on a DELETE of docs/{word}.
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	var word string
+	if i := strings.Index(r.URL.Path, "/docs/"); i >= 0 {
+		word = r.URL.Path[i+len("/docs/"):]
+	}
+
+	switch {
+	case r.Method == "POST" && word == "":
+		limitBody(w, r)
+		var words []string
+		if err := json.NewDecoder(r.Body).Decode(&words); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be a JSON array of words")
+			return
+		}
+		n, err := AddWords(words...)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, map[string]int{"added": n})
+
+	case r.Method == "DELETE" && word != "":
+		n, err := DeleteWord(word)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if n == 0 {
+			writeError(w, http.StatusNotFound, "no document for "+word)
+			return
+		}
+		writeJSON(w, map[string]int{"deleted": n})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "use POST docs or DELETE docs/{word}")
+	}
+}
+
+//compactHandler runs Compact on a POST to /cleo/admin/compact.
+func compactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if err := Compact(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	m := snapshot()
+	writeJSON(w, map[string]int{"documents": m.documents(), "prefixes": m.prefixes()})
+}
+
+//reloadHandler rebuilds the index on a POST to /cleo/admin/reload,
+//from the posted corpus if there is one and otherwise from the corpus
+//file the index was built from.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var stats BuildStats
+	var err error
+	if r.ContentLength == 0 {
+		stats, err = ReloadIndexes()
+	} else {
+		stats, err = ReloadIndexesFrom(r.Body)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
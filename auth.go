@@ -0,0 +1,47 @@
+package cleo
+
+import (
+	"net/http"
+	"strings"
+)
+
+//A TokenValidator reports whether an API key or bearer token may use
+//the cleo endpoints.
+type TokenValidator func(token string) bool
+
+//ValidateToken, when set, must accept the credentials of every request
+//to the cleo endpoints.  Requests without credentials get a 401, and
+//requests whose token is rejected get a 403.  Set it before serving.
+var ValidateToken TokenValidator
+
+//requireAuth checks the request's credentials with ValidateToken
+//before calling h.  Failures count against the remote IP's bucket in
+//RateLimit, which answers with a 429 once it is empty.
+func requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ValidateToken != nil {
+			token := requestToken(r)
+			if token == "" || !ValidateToken(token) {
+				switch {
+				case limited(w, "auth:"+remoteIP(r)):
+				case token == "":
+					w.Header().Set("WWW-Authenticate", `Bearer realm="cleo"`)
+					writeError(w, http.StatusUnauthorized, "missing API key or bearer token")
+				default:
+					writeError(w, http.StatusForbidden, "invalid API key or bearer token")
+				}
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+//requestToken returns the bearer token from the Authorization header,
+//or else the X-Api-Key header.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.Header.Get("X-Api-Key")
+}
@@ -19,14 +19,21 @@ package cleo
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
-	_ "expvar"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func Min(a ...int) int {
@@ -48,40 +55,358 @@ func Max(a ...int) int {
 	return max
 }
 
+//An indexContainer is never modified once it is being served, so
+//searches can read it without locking.  Updates copy it and swap the
+//copy in.
 type indexContainer struct {
-	iIndex *InvertedIndex
-	fIndex *ForwardIndex
+	iIndex     *InvertedIndex
+	fIndex     *ForwardIndex
+	score      fn_score
+	corpusPath string
+	generation uint64 //unique to each container served
+
+	//Updates are kept in delta rather than copying the maps above, which
+	//are then only the base the delta applies to.  See update.go.
+	delta  *indexDelta
+	merge  sync.Once
+	merged *indexContainer //the maps with the delta applied, made by maps
+	nextId int             //next document id, 0 until an update needs it
 }
 
-var m *indexContainer
-var chosenScoringFunction fn_score
+//current holds the *indexContainer being served.  Rebuilds fill a new
+//container off to the side and swap it in whole, so in-flight searches
+//keep reading a consistent old one.
+var current atomic.Value
 
-func init() {
-	http.HandleFunc("/cleo", searchHandler)
+//writeMu serializes rebuilds and updates of the served index.
+var writeMu sync.Mutex
+
+//generations numbers the containers as they start being served.
+var generations uint64
+
+//publish starts serving m in place of the current container.
+func publish(m *indexContainer) {
+	m.generation = atomic.AddUint64(&generations, 1)
+	current.Store(m)
+}
+
+//snapshot returns the container being served, or nil before the
+//first BuildIndexes.
+func snapshot() *indexContainer {
+	m, _ := current.Load().(*indexContainer)
+	return m
 }
 
+//chosenScoringFunction returns the scorer of the served index, falling
+//back to Score when no index has been built.
+func chosenScoringFunction() fn_score {
+	if m := snapshot(); m != nil {
+		return m.score
+	}
+	return Score
+}
+
+//BuildIndexes reads the corpus into a fresh set of indexes and then
+//starts serving them.  It can be called again to rebuild; searches
+//running meanwhile are answered from the previous indexes.
 func BuildIndexes(corpusPath string, scoringFunction fn_score) {
-	m = &indexContainer{}
+	m := &indexContainer{corpusPath: corpusPath}
 	m.iIndex = NewInvertedIndex()
 	m.fIndex = NewForwardIndex()
 
-	chosenScoringFunction = scoringFunction
+	m.score = scoringFunction
 	if scoringFunction == nil {
-		chosenScoringFunction = Score
+		m.score = Score
 	}
 
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
 	InitIndex(m.iIndex, m.fIndex, corpusPath)
+	publish(m)
+	if err := checkpointJournal(); err != nil {
+		log.Print(err)
+	}
+}
+
+//BuildStats describes a finished index build.
+type BuildStats struct {
+	Documents int           `json:"documents"`
+	Prefixes  int           `json:"prefixes"`
+	Took      time.Duration `json:"took_ns"`
+}
+
+//ReloadIndexes rebuilds the served index from the corpus file or URL
+//it was built from, keeping its scorer.  Unlike BuildIndexes it
+//reports a missing corpus as an error instead of exiting.
+func ReloadIndexes() (BuildStats, error) {
+	m := snapshot()
+	if m == nil {
+		return BuildStats{}, ErrNoIndex
+	}
+	if m.corpusPath == "" {
+		return BuildStats{}, errors.New("cleo: the served index has no corpus file to reload")
+	}
+	file, err := Open(context.Background(), m.corpusPath)
+	if err != nil {
+		return BuildStats{}, err
+	}
+	defer file.Close()
+	return ReloadIndexesFrom(file)
+}
+
+//ReloadIndexesFrom rebuilds the served index from corpus, one document
+//per line, keeping its scorer.
+func ReloadIndexesFrom(corpus io.Reader) (BuildStats, error) {
+	start := time.Now()
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	old := snapshot()
+	if old == nil {
+		return BuildStats{}, ErrNoIndex
+	}
+	m := &indexContainer{iIndex: NewInvertedIndex(), fIndex: NewForwardIndex(), score: old.score, corpusPath: old.corpusPath}
+	readCorpus(m.iIndex, m.fIndex, corpus)
+	publish(m)
+	if err := checkpointJournal(); err != nil {
+		return BuildStats{}, err
+	}
+
+	return BuildStats{len(*m.fIndex), m.iIndex.Size(), time.Since(start)}, nil
 }
 
 //Search handles the web requests and writes the output as
-//json data.
+//json data, or MessagePack if the client accepts it.  The optional
+//limit and offset parameters page through the ranked results.
 func searchHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	query := r.FormValue("query")
+	if err := checkQuery(query); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	searchResult := CleoSearch(m.iIndex, m.fIndex, query)
+	m := requestIndex(r)
+	if m == nil {
+		writeError(w, http.StatusServiceUnavailable, "index not built")
+		return
+	}
+	score, err := requestScorer(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	etag := responseETag(r, m)
+	if notModified(w, r, etag) {
+		return
+	}
+
+	ctx, cancel := handlerContext(r)
+	defer cancel()
+	searchResult, err := search(ctx, m, m, query, score)
+	if err != nil {
+		searchFailed(w, err)
+		return
+	}
 	sort.Sort(ByScore{searchResult})
-	myJson, _ := json.Marshal(searchResult)
-	fmt.Fprintf(w, string(myJson))
+	total := len(searchResult)
+	searchResult = page(searchResult, limit, offset)
+	truncated := offset+len(searchResult) < total
+	cacheHeaders(w, etag)
+	noteResults(w, len(searchResult), truncated)
+	f := serverOptions.Response
+	if wantsNDJSON(r) {
+		var header interface{}
+		if f.Envelope {
+			header = f.header(query, total, time.Since(start), truncated)
+		}
+		streamResults(w, f, header, searchResult)
+		return
+	}
+	body := f.body(query, searchResult, total, time.Since(start), truncated)
+	if wantsMsgpack(r) {
+		writeMsgpack(w, appendValue(nil, body))
+		return
+	}
+	myJson, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(myJson)
+}
+
+//batchHandler answers a POSTed JSON array of queries with an array of
+//result sets, one per query and in the same order.  limit and offset
+//apply to each result set.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limitBody(w, r)
+	var queries []string
+	if err := json.NewDecoder(r.Body).Decode(&queries); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON array of queries")
+		return
+	}
+	if max := serverOptions.MaxBatch; max > 0 && len(queries) > max {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %d queries per batch", max))
+		return
+	}
+	for _, q := range queries {
+		if err := checkQuery(q); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	score, err := requestScorer(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	m := requestIndex(r)
+	if m == nil {
+		writeError(w, http.StatusServiceUnavailable, "index not built")
+		return
+	}
+
+	ctx, cancel := handlerContext(r)
+	defer cancel()
+	rslts, err := searchBatch(ctx, m, m, queries, score)
+	if err != nil {
+		searchFailed(w, err)
+		return
+	}
+	n, anyTruncated := 0, false
+	totals := make([]int, len(rslts))
+	for i := range rslts {
+		sort.Sort(ByScore{rslts[i]})
+		totals[i] = len(rslts[i])
+		rslts[i] = page(rslts[i], limit, offset)
+		n += len(rslts[i])
+		anyTruncated = anyTruncated || offset+len(rslts[i]) < totals[i]
+	}
+	noteResults(w, n, anyTruncated)
+	took := time.Since(start)
+	bodies := make([]interface{}, len(rslts))
+	for i, rslt := range rslts {
+		bodies[i] = serverOptions.Response.body(queries[i], rslt, totals[i], took, offset+len(rslt) < totals[i])
+	}
+	if wantsMsgpack(r) {
+		writeMsgpack(w, appendValue(nil, bodies))
+		return
+	}
+	myJson, _ := json.Marshal(bodies)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(myJson)
+}
+
+//wantsNDJSON reports whether the client asked for newline-delimited
+//JSON, either with ?stream=1 or an Accept header.
+func wantsNDJSON(r *http.Request) bool {
+	if r.FormValue("stream") == "1" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+//streamResults writes one JSON object per line, flushing as it goes,
+//so large result sets never sit in memory as a single JSON array.  A
+//non-nil header is written as the first line.
+func streamResults(w http.ResponseWriter, f ResponseFormat, header interface{}, rslt []RankedResult) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	if header != nil {
+		if err := enc.Encode(header); err != nil {
+			return
+		}
+	}
+	for i, ranked := range rslt {
+		if err := enc.Encode(f.result(ranked)); err != nil {
+			return //client went away
+		}
+		if flusher != nil && (i+1)%streamFlushInterval == 0 {
+			flusher.Flush()
+		}
+	}
+}
+
+const streamFlushInterval = 64
+
+//handlerContext returns the context a handler searches with: the
+//request's, ended after HandlerTimeout when one is set.
+func handlerContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if timeout := serverOptions.HandlerTimeout; timeout > 0 {
+		return context.WithTimeout(r.Context(), timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+//searchFailed replies to a search whose context ended.  A client that
+//went away gets no reply.
+func searchFailed(w http.ResponseWriter, err error) {
+	if err == context.DeadlineExceeded {
+		writeError(w, http.StatusGatewayTimeout, "search timed out")
+	}
+}
+
+//writeError replies with a JSON body of the form {"error": msg}.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	body, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+//pageParams reads the limit and offset parameters.  A missing limit
+//is returned as -1, meaning all results; larger limits are clamped to
+//MaxLimit.
+func pageParams(r *http.Request) (limit, offset int, err error) {
+	limit = -1
+	if v := r.FormValue("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return 0, 0, fmt.Errorf("invalid limit %q", v)
+		}
+		if max := serverOptions.MaxLimit; max > 0 {
+			limit = Min(limit, max)
+		}
+	}
+	if v := r.FormValue("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	return limit, offset, nil
+}
+
+//page returns the results from offset on, at most limit of them
+//unless limit is negative.
+func page(rslt []RankedResult, limit, offset int) []RankedResult {
+	if offset >= len(rslt) {
+		return rslt[:0]
+	}
+	rslt = rslt[offset:]
+	if limit >= 0 && limit < len(rslt) {
+		rslt = rslt[:limit]
+	}
+	return rslt
 }
 
 func InitIndex(iIndex *InvertedIndex, fIndex *ForwardIndex, corpusPath string) {
@@ -91,21 +416,59 @@ func InitIndex(iIndex *InvertedIndex, fIndex *ForwardIndex, corpusPath string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer file.Close()
+
+	readCorpus(iIndex, fIndex, file)
+}
 
-	r := bufio.NewReader(file)
-	docID := 1
+//parallelCorpusLines is the corpus size from which readCorpus indexes
+//in parallel.
+var parallelCorpusLines = 10000
+
+//readCorpus indexes each line of the corpus as a document.  Large
+//corpora are cut into chunks that are indexed in parallel and merged
+//in order, giving the same indexes as indexing line by line.
+func readCorpus(iIndex *InvertedIndex, fIndex *ForwardIndex, corpus io.Reader) {
+	r := bufio.NewReader(corpus)
+	var lines []string
 
 	for {
 		line, err := r.ReadString('\n')
 		if err != nil {
 			break
 		}
-		filter := computeBloomFilter(line)
+		lines = append(lines, line)
+	}
 
-		iIndex.AddDoc(docID, line, filter) //insert into inverted index
-		fIndex.AddDoc(docID, line)         //Insert into forward index
+	workers := runtime.GOMAXPROCS(0)
+	if len(lines) < parallelCorpusLines || workers < 2 {
+		workers = 1
+	}
+	chunk := (len(lines) + workers - 1) / workers
+	parts := make([]*InvertedIndex, 0, workers)
+	var wg sync.WaitGroup
+
+	for lo := 0; lo < len(lines); lo += chunk {
+		part, hi := NewInvertedIndex(), Min(lo+chunk, len(lines))
+		parts = append(parts, part)
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			for i := lo; i < hi; i++ {
+				part.AddDoc(i+1, lines[i], computeBloomFilter(lines[i])) //docIDs start at 1
+			}
+		}(lo, hi)
+	}
+	for i, line := range lines {
+		fIndex.AddDoc(i+1, line)
+	}
+	wg.Wait()
 
-		docID++
+	//Merging the chunks in order keeps each bucket sorted by docID
+	for _, part := range parts {
+		for prefix, docs := range *part {
+			(*iIndex)[prefix] = append((*iIndex)[prefix], docs...)
+		}
 	}
 }
 
@@ -121,25 +484,226 @@ type RankedResult struct {
 	Score float64
 }
 
+//CandidateSource hands back the documents sharing the query's prefix.
+//The InvertedIndex is the default, but any backend that can produce
+//the prefix bucket for a query can be searched by CleoSearch.  Other
+//backends build the documents with NewDocument.
+type CandidateSource interface {
+	PrefixCandidates(query string) []Document
+}
+
+//A PrefixKeyer is a CandidateSource that can tell which queries share
+//a prefix bucket, so CleoSearchBatch fetches each bucket only once.
+type PrefixKeyer interface {
+	PrefixKey(query string) string
+}
+
+//DocumentSource returns the word of a document by id, or "" for a
+//document that does not exist.  The ForwardIndex is the default.
+type DocumentSource interface {
+	Lookup(docId int) string
+}
+
+//A QueryRewriter rewrites a query before candidates are fetched, for
+//example to expand a known abbreviation.
+type QueryRewriter func(query string) string
+
+var rewriters []QueryRewriter
+
+//RegisterQueryRewriter adds a rewriter to run on every query, after
+//those already registered.  It is not safe to call while searches
+//are running, so register rewriters before serving.
+func RegisterQueryRewriter(rewriter QueryRewriter) {
+	rewriters = append(rewriters, rewriter)
+}
+
+func rewriteQuery(query string) string {
+	for _, rewrite := range rewriters {
+		query = rewrite(query)
+	}
+	return query
+}
+
 //This is the meat of the search.  It first checks the inverted index
 //for matches, then filters the potentially numerous results using
 //the bloom filter.  Finally, it ranks the word using a Levenshtein
 //distance.
-func CleoSearch(iIndex *InvertedIndex, fIndex *ForwardIndex, query string) []RankedResult {
-	rslt := make([]RankedResult, 0, 0)
+//
+//The query is first passed through the registered QueryRewriters.
+//Terms prefixed with '-' are exclusions: "app -apple" searches for
+//"app" and drops any candidate starting with "apple".
+func CleoSearch(iIndex CandidateSource, fIndex DocumentSource, query string) []RankedResult {
+	rslt, _ := CleoSearchContext(context.Background(), iIndex, fIndex, query)
+	return rslt
+}
+
+//CleoSearchContext is CleoSearch with a context.  Ranking stops early
+//once the context is done, returning the context's error, so abandoned
+//requests stop consuming CPU.
+func CleoSearchContext(ctx context.Context, iIndex CandidateSource, fIndex DocumentSource, query string) ([]RankedResult, error) {
+	return search(ctx, iIndex, fIndex, query, chosenScoringFunction())
+}
+
+//CleoSearchWith is CleoSearch ranking with score instead of the
+//served index's scorer, for comparing scorers on the same index.
+func CleoSearchWith(iIndex CandidateSource, fIndex DocumentSource, query string, score fn_score) []RankedResult {
+	rslt, _ := search(context.Background(), iIndex, fIndex, query, score)
+	return rslt
+}
+
+//search is CleoSearchContext ranking with the given scorer.
+func search(ctx context.Context, iIndex CandidateSource, fIndex DocumentSource, query string, score fn_score) ([]RankedResult, error) {
+	start := time.Now()
+
+	query, excluded := parseQuery(rewriteQuery(query))
+	candidates := iIndex.PrefixCandidates(query) //First get candidates from Inverted Index
+	defer SlowQueries.observe(query, start, len(candidates), score)
+	defer stats.observe(start)
+
+	return rankCandidates(ctx, candidates, fIndex, query, excluded, score)
+}
+
+//CleoSearchBatch runs several queries at once, returning the results
+//in the same order as the queries.  Queries are grouped by prefix so
+//each prefix bucket is fetched only once, which pays off for clients
+//that send many variants of the same query.
+func CleoSearchBatch(iIndex CandidateSource, fIndex DocumentSource, queries []string) [][]RankedResult {
+	rslts, _ := searchBatch(context.Background(), iIndex, fIndex, queries, chosenScoringFunction())
+	return rslts
+}
+
+//searchBatch is CleoSearchBatch ranking with the given scorer.  It
+//stops at the first query ctx ends during.
+func searchBatch(ctx context.Context, iIndex CandidateSource, fIndex DocumentSource, queries []string, score fn_score) ([][]RankedResult, error) {
+	type parsed struct {
+		pos      int
+		query    string
+		prefix   string
+		excluded []string
+	}
+
+	//Without a PrefixKeyer only identical queries can share a lookup
+	key := func(query string) string { return query }
+	if k, ok := iIndex.(PrefixKeyer); ok {
+		key = k.PrefixKey
+	}
+
+	batch := make([]parsed, len(queries))
+	for i, q := range queries {
+		query, excluded := parseQuery(rewriteQuery(q))
+		batch[i] = parsed{i, query, key(query), excluded}
+	}
+	sort.SliceStable(batch, func(i, j int) bool { return batch[i].prefix < batch[j].prefix })
+
+	rslts := make([][]RankedResult, len(queries))
+	var candidates []Document
+	for i, p := range batch {
+		start := time.Now()
+		if i == 0 || p.prefix != batch[i-1].prefix {
+			candidates = iIndex.PrefixCandidates(p.query)
+		}
+		var err error
+		if rslts[p.pos], err = rankCandidates(ctx, candidates, fIndex, p.query, p.excluded, score); err != nil {
+			return nil, err
+		}
+		SlowQueries.observe(p.query, start, len(candidates), score)
+		stats.observe(start)
+	}
+	return rslts, nil
+}
 
-	candidates := iIndex.Search(query) //First get candidates from Inverted Index
+//rankCandidates filters the candidates with the query's bloom filter
+//and scores the survivors with score.  The context is checked every
+//cancelCheckInterval candidates.
+func rankCandidates(ctx context.Context, candidates []Document, fIndex DocumentSource, query string, excluded []string, score fn_score) ([]RankedResult, error) {
+	rslt := make([]RankedResult, 0, 0)
 	qBloom := computeBloomFilter(query)
+	rejected := 0
 
-	for _, i := range candidates {
+	for n, i := range candidates {
+		if n%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				stats.bloomChecked(n, rejected)
+				return nil, err
+			}
+		}
 		if TestBytesFromQuery(i.bloom, qBloom) == true { //Filter using Bloom Filter
-			c := fIndex.itemAt(i.docId)              //Get whole document from Forward Index
-			score := chosenScoringFunction(query, c) //Score the Forward Index between 0-1
-			ranked := RankedResult{c, score}
+			c := fIndex.Lookup(i.docId)             //Get whole document from Forward Index
+			if c == "" || isExcluded(c, excluded) { //Deleted, or excluded by the query
+				continue
+			}
+			ranked := RankedResult{c, score(query, c)} //Score the Forward Index between 0-1
 			rslt = append(rslt, ranked)
+		} else {
+			rejected++
 		}
 	}
-	return rslt
+	stats.bloomChecked(len(candidates), rejected)
+	return rslt, nil
+}
+
+const cancelCheckInterval = 256
+
+//Logger is the part of *log.Logger that cleo writes diagnostics to.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+//SlowQueryLog configures logging of pathological queries.  A query is
+//logged when it takes at least Latency, or when its prefix bucket holds
+//at least Candidates documents.  A zero threshold is ignored.
+type SlowQueryLog struct {
+	Logger     Logger
+	Latency    time.Duration
+	Candidates int
+}
+
+//SlowQueries enables slow query logging when set.  Set it before
+//serving; it is read without locking.
+var SlowQueries *SlowQueryLog
+
+func (s *SlowQueryLog) observe(query string, start time.Time, candidates int, score fn_score) {
+	if s == nil || s.Logger == nil {
+		return
+	}
+	took := time.Since(start)
+	if (s.Latency <= 0 || took < s.Latency) && (s.Candidates <= 0 || candidates < s.Candidates) {
+		return
+	}
+	s.Logger.Printf("cleo: slow query %q: took %v, prefix bucket %q has %d candidates, scorer %s",
+		query, took, getPrefix(query), candidates, scorerName(score))
+}
+
+//parseQuery splits the negated terms (those starting with '-') out
+//of a query.  The rest of the query is returned as the search term.
+func parseQuery(query string) (string, []string) {
+	var terms, excluded []string
+	for _, term := range strings.Fields(query) {
+		if len(term) > 1 && term[0] == '-' {
+			excluded = append(excluded, strings.ToLower(term[1:]))
+		} else {
+			terms = append(terms, term)
+		}
+	}
+	if excluded == nil {
+		return query, nil
+	}
+	return strings.Join(terms, " "), excluded
+}
+
+//isExcluded reports whether the candidate starts with any of the
+//negated terms, ignoring case.
+func isExcluded(candidate string, excluded []string) bool {
+	if len(excluded) == 0 {
+		return false
+	}
+	c := strings.ToLower(candidate)
+	for _, e := range excluded {
+		if strings.HasPrefix(c, e) {
+			return true
+		}
+	}
+	return false
 }
 
 //Iterates through all of the 8 bytes (64 bits) and tests
@@ -194,8 +758,11 @@ func LevenshteinDistance(s, t string) int {
 	return d[m*(width)+0]
 }
 
+//prefixLength is how many bytes of each word key the inverted index.
+const prefixLength = 4
+
 func getPrefix(query string) string {
-	qLen := Min(len(query), 4)
+	qLen := Min(len(query), prefixLength)
 	q := query[0:qLen]
 	return strings.ToLower(q)
 }
@@ -205,6 +772,17 @@ type Document struct {
 	bloom int
 }
 
+//NewDocument returns the candidate a CandidateSource hands back for
+//the document with the given id and word.
+func NewDocument(docId int, word string) Document {
+	return Document{docId: docId, bloom: computeBloomFilter(word)}
+}
+
+//ID returns the id the document is looked up by in a DocumentSource.
+func (d Document) ID() int {
+	return d.docId
+}
+
 //Used for the bloom filter
 const (
 	FNV_BASIS_64 = uint64(14695981039346656037)
@@ -289,6 +867,16 @@ func (x *InvertedIndex) Search(query string) []Document {
 	return nil
 }
 
+//PrefixCandidates makes the InvertedIndex a CandidateSource.
+func (x *InvertedIndex) PrefixCandidates(query string) []Document {
+	return x.Search(query)
+}
+
+//PrefixKey names the bucket PrefixCandidates returns for query.
+func (x *InvertedIndex) PrefixKey(query string) string {
+	return getPrefix(query)
+}
+
 //Forward Index - Maps the document id to the document
 type ForwardIndex map[int]string
 
@@ -296,14 +884,18 @@ func NewForwardIndex() *ForwardIndex {
 	i := make(ForwardIndex)
 	return &i
 }
+//AddDoc keeps the whole document, its words separated by single
+//spaces, so searches return and score every word of it.
 func (x *ForwardIndex) AddDoc(docId int, doc string) {
-	for _, word := range strings.Fields(doc) {
-		_, ok := (*x)[docId]
-		if !ok {
-			(*x)[docId] = word
-		}
+	if doc = strings.Join(strings.Fields(doc), " "); doc != "" {
+		(*x)[docId] = doc
 	}
 }
 func (x *ForwardIndex) itemAt(i int) string {
 	return (*x)[i]
 }
+
+//Lookup makes the ForwardIndex a DocumentSource.
+func (x *ForwardIndex) Lookup(docId int) string {
+	return x.itemAt(docId)
+}
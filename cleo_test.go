@@ -1,6 +1,32 @@
 package cleo
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
 
 func TestLevenshtein(t *testing.T) {
 	if LevenshteinDistance("abcdefghij", "abcdefghix") != 1 {
@@ -15,3 +41,1484 @@ func TestLevenshtein(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestNegativeTerms(t *testing.T) {
+	iIndex := NewInvertedIndex()
+	fIndex := NewForwardIndex()
+	for i, word := range []string{"apple", "application", "apply", "applesauce"} {
+		iIndex.AddDoc(i+1, word, computeBloomFilter(word))
+		fIndex.AddDoc(i+1, word)
+	}
+
+	for _, r := range CleoSearch(iIndex, fIndex, "appl -apple") {
+		if r.Word == "apple" || r.Word == "applesauce" {
+			t.Errorf("excluded word %q returned", r.Word)
+		}
+	}
+
+	if len(CleoSearch(iIndex, fIndex, "appl")) != 4 {
+		t.Fail()
+	}
+}
+
+func TestQueryRewriter(t *testing.T) {
+	defer func(r []QueryRewriter) { rewriters = r }(rewriters)
+
+	iIndex := NewInvertedIndex()
+	fIndex := NewForwardIndex()
+	iIndex.AddDoc(1, "television", computeBloomFilter("television"))
+	fIndex.AddDoc(1, "television")
+
+	RegisterQueryRewriter(func(q string) string {
+		if q == "tv" {
+			return "television"
+		}
+		return q
+	})
+
+	r := CleoSearch(iIndex, fIndex, "tv")
+	if len(r) != 1 || r[0].Word != "television" {
+		t.Fail()
+	}
+}
+
+type logRecorder []string
+
+func (l *logRecorder) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	defer func(s *SlowQueryLog) { SlowQueries = s }(SlowQueries)
+
+	iIndex := NewInvertedIndex()
+	fIndex := NewForwardIndex()
+	for i, word := range []string{"apple", "apply", "ape"} {
+		iIndex.AddDoc(i+1, word, computeBloomFilter(word))
+		fIndex.AddDoc(i+1, word)
+	}
+
+	var logged logRecorder
+	SlowQueries = &SlowQueryLog{Logger: &logged, Candidates: 2}
+
+	CleoSearch(iIndex, fIndex, "ape")
+	CleoSearch(iIndex, fIndex, "appl")
+	if len(logged) != 1 || !strings.Contains(logged[0], `"appl"`) {
+		t.Errorf("unexpected log: %q", logged)
+	}
+}
+
+func TestCleoSearchBatch(t *testing.T) {
+	iIndex := NewInvertedIndex()
+	fIndex := NewForwardIndex()
+	for i, word := range []string{"apple", "apply", "banana", "band"} {
+		iIndex.AddDoc(i+1, word, computeBloomFilter(word))
+		fIndex.AddDoc(i+1, word)
+	}
+
+	queries := []string{"apple", "band", "appl", "zzz"}
+	batch := CleoSearchBatch(iIndex, fIndex, queries)
+	if len(batch) != len(queries) {
+		t.Fatalf("got %d result sets, want %d", len(batch), len(queries))
+	}
+	for i, q := range queries {
+		want := CleoSearch(iIndex, fIndex, q)
+		if len(batch[i]) != len(want) {
+			t.Errorf("%q: got %d results, want %d", q, len(batch[i]), len(want))
+		}
+	}
+}
+
+//serveWords starts serving an index of the given words.
+func serveWords(words ...string) *indexContainer {
+	m := &indexContainer{iIndex: NewInvertedIndex(), fIndex: NewForwardIndex(), score: Score}
+	for i, word := range words {
+		m.iIndex.AddDoc(i+1, word, computeBloomFilter(word))
+		m.fIndex.AddDoc(i+1, word)
+	}
+	publish(m)
+	return m
+}
+
+func TestSearchHandlerPaging(t *testing.T) {
+	serveWords("apple", "apply", "applet", "appliance")
+
+	var all, paged []RankedResult
+	for _, tc := range []struct {
+		url  string
+		into *[]RankedResult
+	}{
+		{"/cleo?query=appl", &all},
+		{"/cleo?query=appl&limit=2&offset=1", &paged},
+	} {
+		w := httptest.NewRecorder()
+		searchHandler(w, httptest.NewRequest("GET", tc.url, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), tc.into); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(all) != 4 || len(paged) != 2 || paged[0] != all[1] || paged[1] != all[2] {
+		t.Errorf("paging %v gave %v", all, paged)
+	}
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl&limit=-1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("negative limit: got status %d", w.Code)
+	}
+}
+
+func TestCleoSearchContextCanceled(t *testing.T) {
+	m := serveWords("apple", "apply")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := CleoSearchContext(ctx, m.iIndex, m.fIndex, "appl"); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestSearchHandlerNDJSON(t *testing.T) {
+	serveWords("apple", "apply", "applet")
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl&stream=1", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(lines))
+	}
+	var r RankedResult
+	if err := json.Unmarshal([]byte(lines[0]), &r); err != nil || r.Word == "" {
+		t.Errorf("bad line %q: %v", lines[0], err)
+	}
+}
+
+func TestGzipHandler(t *testing.T) {
+	words := make([]string, 200)
+	for i := range words {
+		words[i] = fmt.Sprintf("apple%d", i)
+	}
+	serveWords(words...)
+
+	for _, tc := range []struct {
+		url  string
+		gzip bool
+	}{
+		{"/cleo?query=apple", true},
+		{"/cleo?query=apple&limit=1", false},
+	} {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		gzipHandler(searchHandler)(w, req)
+
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tc.gzip {
+			t.Errorf("%s: gzip = %v, want %v", tc.url, got, tc.gzip)
+			continue
+		}
+		body := io.Reader(w.Body)
+		if tc.gzip {
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		var rslt []RankedResult
+		if err := json.NewDecoder(body).Decode(&rslt); err != nil || len(rslt) == 0 {
+			t.Errorf("%s: decoded %d results: %v", tc.url, len(rslt), err)
+		}
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	defer func(v TokenValidator) { ValidateToken = v }(ValidateToken)
+	serveWords("apple")
+
+	ValidateToken = func(token string) bool { return token == "secret" }
+	h := requireAuth(searchHandler)
+
+	for _, tc := range []struct {
+		header, value string
+		status        int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"Authorization", "Bearer wrong", http.StatusForbidden},
+		{"Authorization", "Bearer secret", http.StatusOK},
+		{"X-Api-Key", "secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/cleo?query=apple", nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s %q: got status %d, want %d", tc.header, tc.value, w.Code, tc.status)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, _ := NewRateLimiter(1, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+	if ok, wait := l.allow("a", now); ok || wait <= 0 || wait > time.Second {
+		t.Errorf("over burst: ok = %v, wait = %v", ok, wait)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("other client was limited")
+	}
+	if ok, _ := l.allow("a", now.Add(time.Second)); !ok {
+		t.Error("bucket did not refill")
+	}
+}
+
+func TestNewRateLimiterInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		rps   float64
+		burst int
+	}{{0, 1}, {-1, 1}, {math.NaN(), 1}, {math.Inf(1), 1}, {1, 0}, {1, -1}} {
+		if _, err := NewRateLimiter(tc.rps, tc.burst); err == nil {
+			t.Errorf("rps %v, burst %d accepted", tc.rps, tc.burst)
+		}
+	}
+}
+
+func TestRateLimitFailedAuth(t *testing.T) {
+	defer func(old *RateLimiter, v TokenValidator) { RateLimit, ValidateToken = old, v }(RateLimit, ValidateToken)
+	RateLimit, _ = NewRateLimiter(1, 3)
+	ValidateToken = func(token string) bool { return token == "good" }
+	h := requireAuth(rateLimit(func(w http.ResponseWriter, r *http.Request) {}))
+
+	status := func(key string) int {
+		req := httptest.NewRequest("GET", "/cleo?query=a", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w.Code
+	}
+
+	var got []int
+	for i := 0; i < 5; i++ {
+		got = append(got, status(fmt.Sprint("guess", i)))
+	}
+	if want := []int{403, 403, 403, 429, 429}; !reflect.DeepEqual(got, want) {
+		t.Errorf("guessed tokens: got statuses %v, want %v", got, want)
+	}
+	if code := status(""); code != http.StatusTooManyRequests {
+		t.Errorf("missing token after guesses: got status %d", code)
+	}
+	if code := status("good"); code != http.StatusOK {
+		t.Errorf("valid token limited by failed guesses: got status %d", code)
+	}
+}
+
+func TestRateLimiterBounded(t *testing.T) {
+	l, _ := NewRateLimiter(1, 1)
+	now := time.Now()
+	for i := 0; i < maxBuckets+10; i++ {
+		l.allow(fmt.Sprint(i), now)
+	}
+	if len(l.buckets) != maxBuckets || l.recent.Len() != maxBuckets {
+		t.Errorf("tracking %d clients, want at most %d", len(l.buckets), maxBuckets)
+	}
+	if ok, _ := l.allow(fmt.Sprint(maxBuckets+9), now); ok {
+		t.Error("recent client forgotten")
+	}
+}
+
+func TestRateLimitInventedKeys(t *testing.T) {
+	defer func(old *RateLimiter, v TokenValidator) { RateLimit, ValidateToken = old, v }(RateLimit, ValidateToken)
+	RateLimit, _ = NewRateLimiter(1, 1)
+	h := rateLimit(func(w http.ResponseWriter, r *http.Request) {})
+
+	status := func(key string) int {
+		req := httptest.NewRequest("GET", "/cleo?query=a", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Api-Key", key)
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w.Code
+	}
+
+	//Without ValidateToken keys are not trusted
+	ValidateToken = nil
+	limited := 0
+	for i := 0; i < 50; i++ {
+		if status(fmt.Sprint("key", i)) == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 49 {
+		t.Errorf("%d of 50 requests with rotating keys limited, want 49", limited)
+	}
+
+	//Accepted keys get a bucket of their own, rejected ones share the IP's
+	ValidateToken = func(token string) bool { return token == "good" }
+	if status("good") != http.StatusOK {
+		t.Error("valid key limited by its IP's bucket")
+	}
+	if status("bad") != http.StatusTooManyRequests {
+		t.Error("rejected key got a bucket of its own")
+	}
+}
+
+func TestAddDeleteCompact(t *testing.T) {
+	old := serveWords("apple", "apply")
+
+	if n, err := AddWords("applet", " "); n != 1 || err != nil {
+		t.Fatalf("AddWords: %d, %v", n, err)
+	}
+	if len(CleoSearch(old.iIndex, old.fIndex, "appl")) != 2 {
+		t.Error("update changed the previously served index")
+	}
+	m := snapshot()
+	if len(CleoSearch(m, m, "appl")) != 3 {
+		t.Error("added word not found")
+	}
+
+	if n, err := DeleteWord("apple"); n != 1 || err != nil {
+		t.Fatalf("DeleteWord: %d, %v", n, err)
+	}
+	m = snapshot()
+	for _, r := range CleoSearch(m, m, "appl") {
+		if r.Word == "apple" {
+			t.Error("deleted word found")
+		}
+	}
+
+	if err := Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if m = snapshot(); len((*m.iIndex)["appl"]) != 2 {
+		t.Errorf("compacted bucket has %d documents, want 2", len((*m.iIndex)["appl"]))
+	}
+}
+
+func TestForwardIndexKeepsWholeDocuments(t *testing.T) {
+	iIndex, fIndex := NewInvertedIndex(), NewForwardIndex()
+	for i, doc := range []string{"new york", "new  jersey", "newark"} {
+		iIndex.AddDoc(i+1, doc, computeBloomFilter(doc))
+		fIndex.AddDoc(i+1, doc)
+	}
+	if (*fIndex)[2] != "new jersey" {
+		t.Errorf("forward index holds %q", (*fIndex)[2])
+	}
+
+	//Documents are returned and scored whole.  Keeping only the first
+	//word, both returned "new" with a perfect score.
+	rslt := CleoSearch(iIndex, fIndex, "new")
+	words := make([]string, len(rslt))
+	for i, r := range rslt {
+		words[i] = r.Word
+		if r.Score != Score("new", r.Word) || r.Score == 1 {
+			t.Errorf("%q scored %v", r.Word, r.Score)
+		}
+	}
+	if !sameWords(words, []string{"new york", "new jersey"}) {
+		t.Errorf("search for new: %q", words)
+	}
+}
+
+func TestDocsHandlerDeletesExactDocument(t *testing.T) {
+	defer func(v TokenValidator) { ValidateToken = v }(ValidateToken)
+	ValidateToken = func(token string) bool { return token == "secret" }
+	serveWords("new", "new york", "new jersey")
+
+	del := func(word string) int {
+		r := httptest.NewRequest("DELETE", "/cleo/admin/docs/"+url.PathEscape(word), nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		requireAdmin(docsHandler)(w, r)
+		return w.Code
+	}
+	if code := del("new"); code != http.StatusOK {
+		t.Fatalf("DELETE new: status %d", code)
+	}
+	if code := del("new"); code != http.StatusNotFound {
+		t.Errorf("DELETE new twice: status %d", code)
+	}
+	m := snapshot()
+	if rslt := CleoSearch(m, m, "new"); len(rslt) != 2 {
+		t.Errorf("DELETE new removed other documents: %v", rslt)
+	}
+	if code := del("new york"); code != http.StatusOK {
+		t.Errorf("DELETE new york: status %d", code)
+	}
+}
+
+func TestUpdatesShareMaps(t *testing.T) {
+	old := serveWords("apple", "apply", "banana")
+	AddWords("new york", "cherry")
+	m := snapshot()
+	if m.iIndex != old.iIndex || m.fIndex != old.fIndex {
+		t.Error("update copied the whole index")
+	}
+	if m.documents() != 5 || m.prefixes() != 5 {
+		t.Errorf("counted %d documents and %d prefixes, want 5 and 5", m.documents(), m.prefixes())
+	}
+	if rslt := CleoSearch(m, m, "new"); len(rslt) != 1 || rslt[0].Word != "new york" {
+		t.Errorf("search for new: %v", rslt)
+	}
+
+	//Only the document that is exactly the words is deleted
+	for _, word := range []string{"new", "york"} {
+		if n, _ := DeleteWord(word); n != 0 {
+			t.Errorf("deleted new york as %q", word)
+		}
+	}
+	if n, err := DeleteWord("new  york"); n != 1 || err != nil {
+		t.Fatalf("DeleteWord: %d, %v", n, err)
+	}
+	m = snapshot()
+	if len(m.bucket("new")) != 0 || len(m.bucket("york")) != 0 || m.prefixes() != 3 {
+		t.Errorf("deleted document left in buckets: %v %v", m.bucket("new"), m.bucket("york"))
+	}
+	if n, _ := DeleteWord("new york"); n != 0 {
+		t.Error("deleted twice")
+	}
+
+	//Merging the delta gives the same index as building it outright
+	AddWords("date")
+	iIndex, fIndex := snapshot().maps()
+	if len(*fIndex) != 5 || (*fIndex)[6] != "date" || len((*iIndex)["date"]) != 1 {
+		t.Errorf("merged forward index %v", *fIndex)
+	}
+}
+
+func TestReloadIndexes(t *testing.T) {
+	corpus := filepath.Join(t.TempDir(), "corpus.txt")
+	if err := os.WriteFile(corpus, []byte("apple\napply\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	BuildIndexes(corpus, nil)
+
+	stats, err := ReloadIndexesFrom(strings.NewReader("banana\nband\nbandit\n"))
+	if err != nil || stats.Documents != 3 || stats.Prefixes != 2 {
+		t.Errorf("ReloadIndexesFrom: %+v, %v", stats, err)
+	}
+
+	stats, err = ReloadIndexes()
+	if err != nil || stats.Documents != 2 {
+		t.Errorf("ReloadIndexes: %+v, %v", stats, err)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	serveWords("apple", "apply", "banana")
+
+	w := httptest.NewRecorder()
+	batchHandler(w, httptest.NewRequest("POST", "/cleo/batch?limit=1", strings.NewReader(`["appl", "bana", "zzz"]`)))
+
+	var rslts [][]RankedResult
+	if err := json.Unmarshal(w.Body.Bytes(), &rslts); err != nil {
+		t.Fatal(err)
+	}
+	if len(rslts) != 3 || len(rslts[0]) != 1 || rslts[1][0].Word != "banana" || len(rslts[2]) != 0 {
+		t.Errorf("got %v", rslts)
+	}
+}
+
+func TestOpenAPIDocumentCoversRoutes(t *testing.T) {
+	body, err := json.Marshal(openapiDocument())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths map[string]map[string]interface{}
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, rt := range routes {
+		path := rt.path
+		if path == "" {
+			path = rt.pattern
+		}
+		if doc.Paths[path][strings.ToLower(rt.method)] == nil {
+			t.Errorf("%s %s missing from OpenAPI document", rt.method, path)
+		}
+	}
+}
+
+func TestAppendValueMsgpack(t *testing.T) {
+	got := appendValue(nil, []interface{}{map[string]interface{}{"b": true, "a": 300, "c": nil}, 5, "x", -1})
+	want := []byte{
+		0x94,      //array of 4
+		0x83,      //map of 3, keys sorted
+		0xa1, 'a', //"a"
+		0xd3, 0, 0, 0, 0, 0, 0, 0x01, 0x2c, //300
+		0xa1, 'b', 0xc3, //"b": true
+		0xa1, 'c', 0xc0, //"c": nil
+		0x05,      //5
+		0xa1, 'x', //"x"
+		0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, //-1
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestAppendResultsMsgpack(t *testing.T) {
+	got := appendResults(nil, []RankedResult{{"ab", 0.5}})
+	want := []byte{
+		0x91, //array of 1
+		0x82, //map of 2
+		0xa4, 'W', 'o', 'r', 'd',
+		0xa2, 'a', 'b',
+		0xa5, 'S', 'c', 'o', 'r', 'e',
+		0xcb, 0x3f, 0xe0, 0, 0, 0, 0, 0, 0, //0.5
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	m := serveWords("apple", "apply")
+
+	e := Explain(m.iIndex, m.fIndex, "appl -apple", "apple")
+	if !e.InBucket || !e.BloomPass || e.ExcludedBy != "apple" || e.Returned {
+		t.Errorf("excluded candidate: %+v", e)
+	}
+
+	e = Explain(m.iIndex, m.fIndex, "appl", "apply")
+	if !e.Returned || e.Rewritten != "appl" || e.Prefix != "appl" {
+		t.Errorf("returned candidate: %+v", e)
+	}
+
+	e = Explain(m.iIndex, m.fIndex, "appl", "banana")
+	if e.InBucket || e.Returned {
+		t.Errorf("candidate outside bucket: %+v", e)
+	}
+
+	for _, query := range []string{"", "-ap"} {
+		if e = Explain(m.iIndex, m.fIndex, query, "apple"); e.Returned || e.Distance != 0 || e.Score != 0 {
+			t.Errorf("%q: %+v", query, e)
+		}
+		w := httptest.NewRecorder()
+		explainHandler(w, httptest.NewRequest("GET", "/cleo/explain?"+url.Values{"query": {query}, "candidate": {"apple"}}.Encode(), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	m := serveWords("apple", "apply", "applet", "appliance")
+
+	s := Suggest(m.iIndex, m.fIndex, "appl", 2)
+	if len(s) != 2 {
+		t.Fatalf("got %d suggestions, want 2", len(s))
+	}
+	for _, sg := range s {
+		if len(sg.Highlight) != 1 || sg.Highlight[0] != [2]int{0, 4} {
+			t.Errorf("%s: highlight %v", sg.Word, sg.Highlight)
+		}
+	}
+}
+
+func TestSuggestHighlightRunes(t *testing.T) {
+	for _, tc := range []struct {
+		query, word string
+		want        int
+	}{
+		{"appl", "Apple", 4},
+		{"straß", "STRAßE", 6},
+		{"İst", "İstanbul", 4},
+		{"éc", "École", 3},
+		{"ép", "École", 2},
+		{"apple pie", "apple", 5},
+		{"a", "\xffa", 0},
+	} {
+		if n := commonPrefixLen(tc.query, tc.word); n != tc.want {
+			t.Errorf("%q in %q: got %d, want %d", tc.query, tc.word, n, tc.want)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	defer func(l Logger) { AccessLog = l }(AccessLog)
+	serveWords("apple", "apply", "applet")
+
+	var logged logRecorder
+	AccessLog = &logged
+	h := accessLog(gzipHandler(searchHandler))
+
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/cleo?query=appl&limit=2", nil))
+	if len(logged) != 1 || !strings.Contains(logged[0], "status=200") ||
+		!strings.Contains(logged[0], "results=2 truncated=true") {
+		t.Errorf("unexpected log: %q", logged)
+	}
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	serveWords("apple", "apply")
+
+	for _, path := range []string{"/cleo/v1/search?query=appl", "/cleo?query=appl"} {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var rslt []RankedResult
+		if err := json.Unmarshal(w.Body.Bytes(), &rslt); err != nil || len(rslt) != 2 {
+			t.Errorf("%s: %d results, %v", path, len(rslt), err)
+		}
+		if v := w.Header().Get("Cleo-Api-Version"); v != apiVersion {
+			t.Errorf("%s: Cleo-Api-Version %q", path, v)
+		}
+	}
+}
+
+func TestServerOptionsLimits(t *testing.T) {
+	defer func(o ServerOptions) { serverOptions = o }(serverOptions)
+	serveWords("apple", "apply", "applet")
+
+	opts := DefaultServerOptions
+	opts.MaxQueryLength = 4
+	opts.MaxLimit = 1
+	if s := NewServer(":0", opts); s.ReadTimeout != opts.ReadTimeout {
+		t.Errorf("ReadTimeout %v not applied", s.ReadTimeout)
+	}
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=apple", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("long query: got status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl&limit=10", nil))
+	var rslt []RankedResult
+	if err := json.Unmarshal(w.Body.Bytes(), &rslt); err != nil || len(rslt) != 1 {
+		t.Errorf("limit not clamped: %d results, %v", len(rslt), err)
+	}
+}
+
+func TestRequestScorer(t *testing.T) {
+	serveWords("apple", "apply")
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=apple&scorer=exact", nil))
+	var rslt []RankedResult
+	if err := json.Unmarshal(w.Body.Bytes(), &rslt); err != nil {
+		t.Fatal(err)
+	}
+	if len(rslt) == 0 || rslt[0].Word != "apple" || rslt[0].Score != 1 {
+		t.Errorf("exact scorer gave %v", rslt)
+	}
+
+	w = httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=apple&scorer=bm25", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown scorer: got status %d", w.Code)
+	}
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	defer func(o ServerOptions) { serverOptions = o }(serverOptions)
+	serveWords("apple", "apply", "applet")
+
+	serverOptions.Response = ResponseFormat{Envelope: true, Results: "items", Word: "text"}
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl&limit=2", nil))
+
+	var body struct {
+		Items     []map[string]interface{}
+		Query     string
+		Total     int
+		Truncated bool
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Items) != 2 || body.Items[0]["text"] == nil || body.Items[0]["Score"] == nil ||
+		body.Query != "appl" || body.Total != 3 || !body.Truncated {
+		t.Errorf("got %+v", body)
+	}
+	//MessagePack carries the same envelope and field names
+	req := httptest.NewRequest("GET", "/cleo?query=appl&limit=2", nil)
+	req.Header.Set("Accept", "application/msgpack")
+	w = httptest.NewRecorder()
+	searchHandler(w, req)
+	mp := w.Body.Bytes()
+	if len(mp) == 0 || mp[0] != 0x85 || !bytes.Contains(mp, appendString(nil, "items")) ||
+		!bytes.Contains(mp, appendString(nil, "text")) || bytes.Contains(mp, []byte("Word")) {
+		t.Errorf("msgpack body % x", mp)
+	}
+
+	//NDJSON streams the envelope's other fields first
+	w = httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl&limit=2&stream=1", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	var header map[string]interface{}
+	var line map[string]interface{}
+	if len(lines) != 3 || json.Unmarshal([]byte(lines[0]), &header) != nil || header["total"] != 3.0 ||
+		json.Unmarshal([]byte(lines[1]), &line) != nil || line["text"] == nil || line["Word"] != nil {
+		t.Errorf("NDJSON body %q", lines)
+	}
+
+	//The OpenAPI document describes the served format
+	schemas := openapiDocument()["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	result := schemas["Result"].(map[string]interface{})["properties"].(map[string]interface{})
+	results := schemas["Results"].(map[string]interface{})["properties"].(map[string]interface{})
+	if result["text"] == nil || result["Word"] != nil || results["items"] == nil || schemas["StreamHeader"] == nil {
+		t.Errorf("OpenAPI schemas %v", schemas)
+	}
+}
+
+func TestNamedIndexes(t *testing.T) {
+	serveWords("apple")
+	corpus := filepath.Join(t.TempDir(), "cities.txt")
+	if err := os.WriteFile(corpus, []byte("amsterdam\namman\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildNamedIndex("cities", corpus, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/cleo/v1/indexes/cities/search?query=amst", nil))
+	var rslt []RankedResult
+	if err := json.Unmarshal(w.Body.Bytes(), &rslt); err != nil || len(rslt) != 1 || rslt[0].Word != "amsterdam" {
+		t.Errorf("cities search: %v, %v", rslt, err)
+	}
+
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/cleo/v1/indexes", nil))
+	var infos []IndexInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil || len(infos) != 2 || infos[0].Name != "cities" {
+		t.Errorf("index list: %v, %v", infos, err)
+	}
+
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/cleo/v1/indexes/brands/search?query=a", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown index: got status %d", w.Code)
+	}
+}
+
+func TestStatsAfterIdleGap(t *testing.T) {
+	var s queryStats
+	now := time.Now()
+	add := func(at time.Time, took time.Duration) {
+		if s.first.IsZero() {
+			s.first = at
+		}
+		s.samples[s.next] = latencySample{at, took}
+		s.next = (s.next + 1) % latencyWindow
+		s.filled = s.filled || s.next == 0
+	}
+
+	//A full ring of slow queries two hours ago, then 30 in the last 30s
+	for i := 0; i < latencyWindow; i++ {
+		add(now.Add(-2*time.Hour), time.Second)
+	}
+	for i := 0; i < 30; i++ {
+		add(now.Add(-time.Duration(30-i)*time.Second), time.Millisecond)
+	}
+	qps, took := s.recent(now)
+	if len(took) != 30 || qps != 0.5 {
+		t.Errorf("after an idle gap: %d latencies at %v QPS, want 30 at 0.5", len(took), qps)
+	}
+	for _, d := range took {
+		if d != time.Millisecond {
+			t.Fatalf("stale latency %v reported", d)
+		}
+	}
+
+	//Nothing in the last minute
+	if qps, took := s.recent(now.Add(time.Hour)); qps != 0 || len(took) != 0 {
+		t.Errorf("idle: %d latencies at %v QPS", len(took), qps)
+	}
+
+	//A ring filled within the window is measured over its own span
+	for i := 0; i < latencyWindow; i++ {
+		add(now.Add(-10*time.Second+time.Duration(i)*10*time.Second/latencyWindow), time.Millisecond)
+	}
+	if qps, _ := s.recent(now); qps < 100 || qps > 103 {
+		t.Errorf("busy: %v QPS, want about 102", qps)
+	}
+}
+
+func TestBuildNamedIndexFromURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/brands.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("acme\nadidas\napple\n"))
+	}))
+	defer srv.Close()
+	defer func() {
+		namedMu.Lock()
+		delete(named, "brands")
+		namedMu.Unlock()
+	}()
+
+	if stats, err := BuildNamedIndex("brands", srv.URL+"/brands.txt", nil); err != nil || stats.Documents != 3 {
+		t.Fatalf("BuildNamedIndex: %+v, %v", stats, err)
+	}
+	if m := namedIndex("brands"); m == nil || len(CleoSearch(m, m, "adid")) != 1 {
+		t.Error("index built from a URL not served")
+	}
+	if _, err := BuildNamedIndex("brands", srv.URL+"/missing.txt", nil); err == nil {
+		t.Error("missing URL built")
+	}
+}
+
+func TestCurrentStats(t *testing.T) {
+	m := serveWords("apple", "apply", "apron")
+	before := CurrentStats()
+
+	CleoSearch(m.iIndex, m.fIndex, "apple")
+	st := CurrentStats()
+	if st.Documents != 3 || st.Queries != before.Queries+1 || st.LatencyP99Ms < st.LatencyP50Ms {
+		t.Errorf("got %+v", st)
+	}
+	if st.BloomRejectRatio <= 0 || st.BloomRejectRatio > 1 {
+		t.Errorf("bloom reject ratio %v", st.BloomRejectRatio)
+	}
+}
+
+func TestETag(t *testing.T) {
+	serveWords("apple", "apply")
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl", nil))
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	req := httptest.NewRequest("GET", "/cleo?query=appl", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	searchHandler(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("matching ETag: got status %d", w.Code)
+	}
+
+	AddWords("applet")
+	w = httptest.NewRecorder()
+	searchHandler(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after update: got status %d, ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+
+	//Errors are not cacheable
+	w = httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl&scorer=nope", nil))
+	if w.Code != http.StatusBadRequest || w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("bad request: got status %d with headers %v", w.Code, w.Header())
+	}
+
+	//Other processes serving the same generation tag differently
+	w = httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl", nil))
+	etag = w.Header().Get("ETag")
+	saved := etagNonce
+	etagNonce = "other"
+	w = httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl", nil))
+	etagNonce = saved
+	if w.Header().Get("ETag") == etag {
+		t.Error("ETag does not depend on the process")
+	}
+
+	//Authenticated responses are not shared
+	defer func(v TokenValidator) { ValidateToken = v }(ValidateToken)
+	ValidateToken = func(string) bool { return true }
+	w = httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl", nil))
+	if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "private") || !strings.Contains(strings.Join(w.Header()["Vary"], ","), "Authorization") {
+		t.Errorf("authenticated response: Cache-Control %q, Vary %q", cc, w.Header()["Vary"])
+	}
+}
+
+func TestSaveLoadIndexes(t *testing.T) {
+	serveWords("apple", "apply", "banana")
+	publish(&indexContainer{iIndex: snapshot().iIndex, fIndex: snapshot().fIndex, score: PrefixScore})
+
+	var buf bytes.Buffer
+	if err := SaveIndexes(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := snapshot()
+	serveWords("zebra")
+
+	if _, err := LoadIndexes(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	m := snapshot()
+	if !reflect.DeepEqual(m.iIndex, saved.iIndex) || !reflect.DeepEqual(m.fIndex, saved.fIndex) {
+		t.Error("loaded index differs from the saved one")
+	}
+	if scorerName(m.score) != "prefix" {
+		t.Errorf("loaded scorer %s, want prefix", scorerName(m.score))
+	}
+
+	if _, err := LoadIndexes(strings.NewReader("not a snapshot")); err != ErrBadSnapshot {
+		t.Errorf("got %v, want ErrBadSnapshot", err)
+	}
+	if _, err := LoadIndexes(bytes.NewReader(buf.Bytes()[:buf.Len()-3])); err == nil {
+		t.Error("truncated snapshot loaded")
+	}
+}
+
+func TestReadCorpusParallel(t *testing.T) {
+	var corpus strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&corpus, "word%d\nappl%d\n", i%37, i)
+	}
+
+	seqI, seqF := NewInvertedIndex(), NewForwardIndex()
+	defer func(n int) { parallelCorpusLines = n }(parallelCorpusLines)
+	parallelCorpusLines = 1 << 30
+	readCorpus(seqI, seqF, strings.NewReader(corpus.String()))
+
+	parI, parF := NewInvertedIndex(), NewForwardIndex()
+	parallelCorpusLines = 1
+	readCorpus(parI, parF, strings.NewReader(corpus.String()))
+
+	if !reflect.DeepEqual(seqI, parI) || !reflect.DeepEqual(seqF, parF) {
+		t.Error("parallel indexing differs from sequential")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	defer func(o ServerOptions) { serverOptions = o }(serverOptions)
+	serverOptions.AllowOrigins = []string{"https://example.com"}
+	called := false
+	h := cors(requireAuth(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	r := httptest.NewRequest("OPTIONS", "/cleo/v1/search", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusNoContent || called || w.Header().Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Errorf("preflight: status %d, called %v, headers %v", w.Code, called, w.Header())
+	}
+
+	r = httptest.NewRequest("GET", "/cleo/v1/search", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	h(w, r)
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin: called %v, headers %v", called, w.Header())
+	}
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	m := serveWords("apple", "apply", "banana")
+	var buf bytes.Buffer
+	if err := SaveIndexes(&buf); err != nil {
+		t.Fatal(err)
+	}
+	report, err := VerifySnapshot(bytes.NewReader(buf.Bytes()))
+	if err != nil || len(report.Problems) != 0 || report.Documents != 3 {
+		t.Errorf("sound snapshot: %+v, %v", report, err)
+	}
+
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if _, err := VerifySnapshot(bytes.NewReader(corrupt)); err == nil {
+		t.Error("corrupted snapshot verified")
+	}
+
+	(*m.iIndex)["bana"][0].bloom = 0
+	delete(*m.iIndex, "appl")
+	if report := m.verify(); len(report.Problems) != 3 {
+		t.Errorf("got problems %q, want 3", report.Problems)
+	}
+}
+
+func TestSaveLoadNamedIndex(t *testing.T) {
+	serveWords("apple", "apply")
+	var buf bytes.Buffer
+	if err := SaveNamedIndex(defaultIndexName, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte(snapshotMagic+"\x01\x03")) {
+		t.Errorf("snapshot header %q, want version 1 with 3 sections", buf.Bytes()[:6])
+	}
+
+	stats, err := LoadNamedIndex("fruit", bytes.NewReader(buf.Bytes()))
+	if err != nil || stats.Documents != 2 {
+		t.Fatalf("LoadNamedIndex: %+v, %v", stats, err)
+	}
+	if rslt := CleoSearch(namedIndex("fruit").iIndex, namedIndex("fruit").fIndex, "appl"); len(rslt) != 2 {
+		t.Errorf("loaded named index returned %v", rslt)
+	}
+	if err := SaveNamedIndex("missing", &buf); err != ErrNoIndex {
+		t.Errorf("saving a missing index: %v", err)
+	}
+	if _, err := LoadNamedIndex("a/b", bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("loaded an index under an invalid name")
+	}
+}
+
+func TestWAL(t *testing.T) {
+	dir := t.TempDir()
+	snap, log := filepath.Join(dir, "index.cleo"), filepath.Join(dir, "index.wal")
+	serveWords("apple", "banana")
+
+	wal, err := OpenWAL(snap, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AddWords("apply", "applet")
+	DeleteWord("banana")
+	wal.Close()
+
+	//Restart: load the snapshot, which predates the updates
+	serveWords()
+	file, err := os.Open(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadIndexes(file)
+	file.Close()
+	if err != nil || len(*snapshot().fIndex) != 2 {
+		t.Fatalf("snapshot: %d documents, %v", len(*snapshot().fIndex), err)
+	}
+	if wal, err = OpenWAL(snap, log); err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	words := make(map[string]bool)
+	_, fIndex := snapshot().maps()
+	for _, w := range *fIndex {
+		words[w] = true
+	}
+	if len(words) != 3 || !words["apply"] || !words["applet"] || words["banana"] {
+		t.Errorf("after replay got %v", words)
+	}
+
+	//OpenWAL checkpointed the replayed updates
+	if fi, err := os.Stat(log); err != nil || fi.Size() != int64(len(walMagic)+4) {
+		t.Errorf("log not emptied by checkpoint: %v, %v", fi, err)
+	}
+}
+
+//walWithRecords leaves a snapshot and a log of n single word additions
+//in dir, returning their paths.
+func walWithRecords(t *testing.T, dir string, n int) (string, string) {
+	snap, log := filepath.Join(dir, "index.cleo"), filepath.Join(dir, "index.wal")
+	serveWords("apple")
+	wal, err := OpenWAL(snap, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		AddWords(fmt.Sprint("word", i))
+	}
+	wal.Close()
+
+	file, err := os.Open(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := LoadIndexes(file); err != nil {
+		t.Fatal(err)
+	}
+	return snap, log
+}
+
+func TestWALReplayPublishesOnce(t *testing.T) {
+	snap, log := walWithRecords(t, t.TempDir(), 50)
+	before := snapshot().generation
+	wal, err := OpenWAL(snap, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if m := snapshot(); m.documents() != 51 || m.generation != before+1 {
+		t.Errorf("replay served %d documents in %d generations", m.documents(), m.generation-before)
+	}
+}
+
+func TestWALDamagedRecords(t *testing.T) {
+	//A torn last record is dropped
+	snap, log := walWithRecords(t, t.TempDir(), 3)
+	data, _ := os.ReadFile(log)
+	os.WriteFile(log, data[:len(data)-2], 0644)
+	wal, err := OpenWAL(snap, log)
+	if err != nil {
+		t.Fatalf("torn tail: %v", err)
+	}
+	wal.Close()
+	if n := snapshot().documents(); n != 3 {
+		t.Errorf("torn tail: %d documents, want 3", n)
+	}
+
+	//A damaged record in the middle is an error, and the log is kept
+	snap, log = walWithRecords(t, t.TempDir(), 3)
+	data, _ = os.ReadFile(log)
+	data[len(walMagic)+4+3] ^= 0xff
+	os.WriteFile(log, data, 0644)
+	if wal, err := OpenWAL(snap, log); err == nil {
+		wal.Close()
+		t.Fatal("damaged record skipped")
+	}
+	if kept, _ := os.ReadFile(log); !bytes.Equal(kept, data) {
+		t.Error("damaged log was replaced")
+	}
+}
+
+func TestWALFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	serveWords("apple")
+	wal, err := OpenWAL(filepath.Join(dir, "index.cleo"), filepath.Join(dir, "index.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	//With the file gone bad neither the write nor the truncate works
+	wal.file.Close()
+	if _, err := AddWords("apply"); err == nil {
+		t.Fatal("update served without being logged")
+	}
+	if wal.failed == nil {
+		t.Error("WAL not marked failed")
+	}
+	if n := snapshot().documents(); n != 1 {
+		t.Errorf("%d documents served, want 1", n)
+	}
+}
+
+func TestLoadFrom(t *testing.T) {
+	body := "apple\napply\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	if _, err := LoadFrom(ctx, srv.URL+"/words.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	if m := snapshot(); len(*m.fIndex) != 2 || m.corpusPath != srv.URL+"/words.txt" {
+		t.Fatalf("loaded %d documents from %q", len(*m.fIndex), m.corpusPath)
+	}
+	if changed, _, err := load(ctx, srv.URL+"/words.txt", nil, true); changed || err != nil {
+		t.Errorf("unchanged corpus reloaded: %v", err)
+	}
+	body = "apple\napply\napplet\n"
+	if changed, _, err := load(ctx, srv.URL+"/words.txt", nil, true); !changed || err != nil || len(*snapshot().fIndex) != 3 {
+		t.Errorf("changed corpus not reloaded: %v", err)
+	}
+
+	//A snapshot is told apart from a corpus by its header
+	var buf bytes.Buffer
+	serveWords("zebra")
+	SaveIndexes(&buf)
+	RegisterFetcher("mem", FetcherFunc(func(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}))
+	defer delete(fetchers, "mem")
+	serveWords()
+	if _, err := LoadFrom(ctx, "mem://index.cleo", nil); err != nil || len(*snapshot().fIndex) != 1 {
+		t.Errorf("snapshot not loaded: %v", err)
+	}
+
+	if _, err := LoadFrom(ctx, "ftp://example.com/words.txt", nil); err == nil {
+		t.Error("URL without a fetcher loaded")
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	defer func(d time.Duration) { FetchTimeout = d }(FetchTimeout)
+	FetchTimeout = 50 * time.Millisecond
+
+	stalled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/body" {
+			w.Write([]byte("apple\napply\n"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-stalled:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(stalled)
+
+	for _, path := range []string{"/headers", "/body"} {
+		start := time.Now()
+		if _, err := LoadFrom(context.Background(), srv.URL+path, nil); err == nil {
+			t.Errorf("%s: stalled server loaded", path)
+		}
+		if took := time.Since(start); took > 5*time.Second {
+			t.Errorf("%s: gave up after %v", path, took)
+		}
+	}
+}
+
+func TestLoadFromFS(t *testing.T) {
+	var buf bytes.Buffer
+	serveWords("zebra", "zeal")
+	SaveIndexes(&buf)
+	fsys := fstest.MapFS{
+		"words.txt":  {Data: []byte("apple\napply\napplet\n")},
+		"index.cleo": {Data: buf.Bytes()},
+	}
+
+	if stats, err := LoadFromFS(fsys, "words.txt", nil); err != nil || stats.Documents != 3 {
+		t.Fatalf("corpus: %+v, %v", stats, err)
+	}
+	if _, err := ReloadIndexes(); err == nil {
+		t.Error("reloaded a corpus read from an fs.FS")
+	}
+	if stats, err := LoadFromFS(fsys, "index.cleo", nil); err != nil || stats.Documents != 2 {
+		t.Errorf("snapshot: %+v, %v", stats, err)
+	}
+	if _, err := LoadFromFS(fsys, "missing.txt", nil); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestMigrateSnapshot(t *testing.T) {
+	serveWords("apple", "apply", "banana")
+	var saved bytes.Buffer
+	if err := SaveIndexes(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	from, err := MigrateSnapshot(&out, bytes.NewReader(saved.Bytes()))
+	if err != nil || from != CurrentSnapshotVersion || !bytes.Equal(out.Bytes(), saved.Bytes()) {
+		t.Errorf("current snapshot: migrated from %d, %v", from, err)
+	}
+
+	for _, header := range []string{"\x00", "\x02", "\x09"} {
+		if _, err := MigrateSnapshot(io.Discard, bytes.NewReader([]byte(snapshotMagic+header))); err == nil {
+			t.Errorf("unknown version %q migrated", header)
+		}
+	}
+}
+
+//fakeBackend is a CandidateSource and DocumentSource built only with
+//exported API, as a backend outside the package would be.
+type fakeBackend struct {
+	words   map[int]string
+	fetches int
+}
+
+func (b *fakeBackend) PrefixCandidates(query string) []Document {
+	b.fetches++
+	var docs []Document
+	for id := 1; id <= len(b.words); id++ {
+		if strings.HasPrefix(b.words[id], strings.ToLower(query[:Min(len(query), 2)])) {
+			docs = append(docs, NewDocument(id, b.words[id]))
+		}
+	}
+	return docs
+}
+
+func (b *fakeBackend) Lookup(docId int) string { return b.words[docId] }
+
+func TestExternalBackend(t *testing.T) {
+	b := &fakeBackend{words: map[int]string{1: "apple", 2: "apply", 3: "banana"}}
+	rslt := CleoSearchWith(b, b, "appl", Score)
+	if len(rslt) != 2 {
+		t.Fatalf("got %v, want apple and apply", rslt)
+	}
+	if doc := NewDocument(7, "x"); doc.ID() != 7 {
+		t.Errorf("ID() = %d", doc.ID())
+	}
+
+	//Without PrefixKey only identical queries share a lookup
+	rslts := CleoSearchBatch(b, b, []string{"appl", "apple", "appl"})
+	if len(rslts) != 3 || len(rslts[0]) != 2 || len(rslts[1]) == 0 || b.fetches != 1+2 {
+		t.Errorf("batch: %v with %d fetches", rslts, b.fetches)
+	}
+}
+
+func TestHandlersUseRequestContext(t *testing.T) {
+	serveWords("apple", "apply", "applet")
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	w := httptest.NewRecorder()
+	batchHandler(w, httptest.NewRequest("POST", "/cleo/batch", strings.NewReader(`["appl", "zzz"]`)).WithContext(expired))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("batch: got status %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+	w = httptest.NewRecorder()
+	suggestHandler(w, httptest.NewRequest("GET", "/cleo/suggest?query=appl", nil).WithContext(expired))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("suggest: got status %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	batchHandler(w, httptest.NewRequest("POST", "/cleo/batch", strings.NewReader(`["appl"]`)).WithContext(gone))
+	if w.Body.Len() != 0 {
+		t.Errorf("batch for a client gone away: got %q", w.Body)
+	}
+}
+
+func TestSearchDuringSwap(t *testing.T) {
+	old := []string{"apple", "apply"}
+	rebuilt := []string{"applet", "appliance", "applesauce"}
+	serveWords(old...)
+
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				searchHandler(w, httptest.NewRequest("GET", "/cleo?query=appl", nil))
+				var rslt []RankedResult
+				if err := json.Unmarshal(w.Body.Bytes(), &rslt); err != nil || w.Code != http.StatusOK {
+					errs <- fmt.Errorf("status %d, %v", w.Code, err)
+					return
+				}
+				words := make([]string, len(rslt))
+				for j, r := range rslt {
+					words[j] = r.Word
+				}
+				if !sameWords(words, old) && !sameWords(words, rebuilt) {
+					errs <- fmt.Errorf("results %q mix two indexes", words)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		corpus := old
+		if i%2 == 0 {
+			corpus = rebuilt
+		}
+		if _, err := ReloadIndexesFrom(strings.NewReader(strings.Join(corpus, "\n") + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+//sameWords reports whether got holds the words of want in any order.
+func sameWords(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, w := range want {
+		seen[w] = true
+	}
+	for _, g := range got {
+		if !seen[g] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestClientCertConfig(t *testing.T) {
+	serveWords("apple", "apply")
+	ca, caKey := newTestCert(t, nil, nil)
+	signed, signedKey := newTestCert(t, ca, caKey)
+	stranger, strangerKey := newTestCert(t, nil, nil)
+	other, otherKey := newTestCert(t, stranger, strangerKey)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ClientCertConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(searchHandler))
+	srv.TLS = config
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"no certificate", nil, false},
+		{"certificate of another CA", []tls.Certificate{{Certificate: [][]byte{other.Raw}, PrivateKey: otherKey}}, false},
+		{"certificate of the CA", []tls.Certificate{{Certificate: [][]byte{signed.Raw}, PrivateKey: signedKey}}, true},
+	} {
+		client := srv.Client()
+		client.Transport.(*http.Transport).TLSClientConfig.Certificates = tc.certs
+		resp, err := client.Get(srv.URL + "/cleo?query=appl")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+
+	if _, err := ClientCertConfig(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
+
+//newTestCert makes a certificate signed by parent, or a self-signed CA
+//when parent is nil.
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "cleo test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.Subject.CommonName = "cleo test CA"
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
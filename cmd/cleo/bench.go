@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jamra/gocleo"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+//runBench replays a query log against an index with each scorer and
+//reports throughput and latency percentiles.
+func runBench(args []string) error {
+	fs := newFlagSet("bench")
+	index, corpus := indexFlags(fs)
+	queries := fs.String("queries", "", "query log to replay, one query per line")
+	concurrency := fs.Int("concurrency", 1, "number of queries run at once")
+	scorerList := fs.String("scorers", strings.Join(cleo.ScorerNames(), ","), "comma separated scorers to compare")
+	fs.Parse(args)
+	if *queries == "" {
+		return fmt.Errorf("bench: -queries is required")
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("bench: -concurrency must be at least 1")
+	}
+
+	qs, err := readLines(*queries)
+	if err != nil {
+		return err
+	}
+	if len(qs) == 0 {
+		return fmt.Errorf("bench: no queries in %s", *queries)
+	}
+	if _, err := loadIndex(*index, *corpus); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "scorer\tqueries\tqps\tp50\tp95\tp99\tmax\t")
+	for _, name := range strings.Split(*scorerList, ",") {
+		score, err := cleo.LookupScorer(strings.TrimSpace(name))
+		if err != nil {
+			return fmt.Errorf("bench: %v", err)
+		}
+		r := bench(qs, score, *concurrency)
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%v\t%v\t%v\t%v\t\n", name, len(qs), float64(len(qs))/r.wall.Seconds(),
+			r.percentile(50), r.percentile(95), r.percentile(99), r.percentile(100))
+	}
+	return tw.Flush()
+}
+
+type benchResult struct {
+	wall      time.Duration
+	latencies []time.Duration //sorted
+}
+
+//percentile returns the latency under which p percent of queries ran.
+func (r benchResult) percentile(p int) time.Duration {
+	i := (len(r.latencies)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.latencies[i]
+}
+
+//bench runs every query once with score, spread over concurrency
+//goroutines.
+func bench(queries []string, score func(query, candidate string) float64, concurrency int) benchResult {
+	iIndex, fIndex := cleo.Indexes()
+	latencies := make([]time.Duration, len(queries))
+	next := make(chan int)
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				t := time.Now()
+				cleo.CleoSearchWith(iIndex, fIndex, queries[i], score)
+				latencies[i] = time.Since(t)
+			}
+		}()
+	}
+	for i := range queries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	r := benchResult{time.Since(start), latencies}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	return r
+}
+
+//readLines returns the non-blank lines of the file at path.
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	in := bufio.NewScanner(file)
+	for in.Scan() {
+		if line := strings.TrimSpace(in.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, in.Err()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jamra/gocleo"
+	"os"
+)
+
+//runBuild indexes a corpus and writes the snapshot, so search and serve
+//can start without rereading the corpus.
+func runBuild(args []string) error {
+	fs := newFlagSet("build")
+	corpus := fs.String("corpus", "", "corpus to index, one word per line")
+	out := fs.String("out", "index.cleo", "snapshot file to write")
+	scorer := fs.String("scorer", "fuzzy", "scorer the snapshot is served with")
+	fs.Parse(args)
+	if *corpus == "" {
+		return fmt.Errorf("build: -corpus is required")
+	}
+	score, err := cleo.LookupScorer(*scorer)
+	if err != nil {
+		return fmt.Errorf("build: %v", err)
+	}
+
+	stats, err := buildIndex(*corpus, score)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := cleo.SaveIndexes(file); err != nil {
+		file.Close()
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("corpus     %s\n", *corpus)
+	fmt.Printf("documents  %d\n", stats.Documents)
+	fmt.Printf("prefixes   %d\n", stats.Prefixes)
+	fmt.Printf("scorer     %s\n", *scorer)
+	fmt.Printf("took       %v\n", stats.Took)
+	fmt.Printf("wrote      %s (%d bytes)\n", *out, fi.Size())
+	return nil
+}
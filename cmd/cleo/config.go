@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/jamra/gocleo"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//serveConfig is the file read by cleo serve -config.  Unset fields keep
+//the defaults of the serve flags and cleo.DefaultServerOptions.
+type serveConfig struct {
+	Addr    string    `json:"addr"`
+	Index   string    `json:"index"`
+	Corpus  string    `json:"corpus"`
+	Scorer  string    `json:"scorer"`  //only used when indexing a corpus
+	Refetch *duration `json:"refetch"` //how often to reload an index or corpus URL
+
+	WAL        string    `json:"wal"`        //write-ahead log for admin updates
+	Checkpoint *duration `json:"checkpoint"` //how often to fold the WAL into the index snapshot
+
+	Limits struct {
+		ReadTimeout    *duration `json:"read_timeout"`
+		WriteTimeout   *duration `json:"write_timeout"`
+		IdleTimeout    *duration `json:"idle_timeout"`
+		HandlerTimeout *duration `json:"handler_timeout"`
+		MaxBodyBytes   *int64    `json:"max_body_bytes"`
+		MaxQueryLength *int      `json:"max_query_length"`
+		MaxLimit       *int      `json:"max_limit"`
+		MaxBatch       *int      `json:"max_batch"`
+		RateLimit      float64   `json:"rate_limit"` //requests a second per client
+		Burst          int       `json:"burst"`
+	} `json:"limits"`
+
+	CORS struct {
+		Origins []string `json:"origins"`
+	} `json:"cors"`
+
+	TLS struct {
+		Cert     string `json:"cert"`
+		Key      string `json:"key"`
+		ClientCA string `json:"client_ca"` //require client certificates signed by this CA
+	} `json:"tls"`
+
+	Auth struct {
+		Tokens     []string `json:"tokens"`
+		TokensFile string   `json:"tokens_file"` //one token per line
+	} `json:"auth"`
+
+	Metrics struct {
+		AccessLog bool      `json:"access_log"`
+		SlowQuery *duration `json:"slow_query"` //log searches slower than this
+	} `json:"metrics"`
+}
+
+//A duration is written as a Go duration string like "10s", or a
+//number of seconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var secs float64
+	if err := json.Unmarshal(b, &secs); err == nil {
+		*d = duration(secs * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("want a duration like \"10s\", got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+//readServeConfig reads a JSON config file, or a YAML one when its name
+//ends in .yaml or .yml.  Unknown keys are errors, to catch typos.
+func readServeConfig(path string) (*serveConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		v, err := parseYAML(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if data, err = json.Marshal(typeYAML(v, reflect.TypeOf(serveConfig{}))); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		return nil, fmt.Errorf("%s: TOML is not supported, use YAML or JSON", path)
+	}
+
+	c := new(serveConfig)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+//validate checks the settings that could otherwise only fail once the
+//index is loaded and the server is starting.
+func (c *serveConfig) validate() error {
+	location := c.Index
+	if location == "" {
+		location = c.Corpus
+	}
+	if c.Refetch != nil && *c.Refetch > 0 && (!isURL(location) || c.WAL != "") {
+		return fmt.Errorf("serve: refetch needs an -index or -corpus URL and no -wal")
+	}
+	if c.WAL != "" && c.Index == "" {
+		return fmt.Errorf("serve: a WAL needs the snapshot given with -index to checkpoint into")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("serve: tls.cert and tls.key must be given together")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		return fmt.Errorf("serve: tls.client_ca needs tls.cert and tls.key")
+	}
+	if c.Limits.RateLimit < 0 || c.Limits.Burst < 0 {
+		return fmt.Errorf("serve: limits.rate_limit and limits.burst must not be negative")
+	}
+	if c.Scorer != "" {
+		if _, err := cleo.LookupScorer(c.Scorer); err != nil {
+			return fmt.Errorf("serve: %v", err)
+		}
+	}
+	return nil
+}
+
+//serverOptions applies the limits and CORS settings to opts.
+func (c *serveConfig) serverOptions(opts cleo.ServerOptions) cleo.ServerOptions {
+	l := c.Limits
+	setDuration(&opts.ReadTimeout, l.ReadTimeout)
+	setDuration(&opts.WriteTimeout, l.WriteTimeout)
+	setDuration(&opts.IdleTimeout, l.IdleTimeout)
+	setDuration(&opts.HandlerTimeout, l.HandlerTimeout)
+	if l.MaxBodyBytes != nil {
+		opts.MaxBodyBytes = *l.MaxBodyBytes
+	}
+	if l.MaxQueryLength != nil {
+		opts.MaxQueryLength = *l.MaxQueryLength
+	}
+	if l.MaxLimit != nil {
+		opts.MaxLimit = *l.MaxLimit
+	}
+	if l.MaxBatch != nil {
+		opts.MaxBatch = *l.MaxBatch
+	}
+	opts.AllowOrigins = c.CORS.Origins
+	return opts
+}
+
+func setDuration(dst *time.Duration, d *duration) {
+	if d != nil {
+		*dst = time.Duration(*d)
+	}
+}
+
+//install sets the package level hooks for auth, rate limiting and
+//logging.
+func (c *serveConfig) install() error {
+	tokens := c.Auth.Tokens
+	if c.Auth.TokensFile != "" {
+		lines, err := readLines(c.Auth.TokensFile)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, lines...)
+	}
+	if len(tokens) > 0 {
+		cleo.ValidateToken = func(token string) bool {
+			ok := false
+			for _, t := range tokens {
+				ok = subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 || ok
+			}
+			return ok
+		}
+	}
+
+	if l := c.Limits; l.RateLimit > 0 {
+		burst := l.Burst
+		if burst < 1 {
+			burst = int(l.RateLimit) + 1
+		}
+		limiter, err := cleo.NewRateLimiter(l.RateLimit, burst)
+		if err != nil {
+			return err
+		}
+		cleo.RateLimit = limiter
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	if c.Metrics.AccessLog {
+		cleo.AccessLog = logger
+	}
+	if c.Metrics.SlowQuery != nil {
+		cleo.SlowQueries = &cleo.SlowQueryLog{Logger: logger, Latency: time.Duration(*c.Metrics.SlowQuery)}
+	}
+	return nil
+}
+
+//parseYAML reads the subset of YAML config files need: nested
+//mappings, block and flow sequences of scalars, quoted and plain
+//scalars, and comments.  Anchors, multi-line strings and sequences of
+//mappings are not supported.
+func parseYAML(src string) (interface{}, error) {
+	type line struct {
+		n      int
+		indent int
+		text   string
+	}
+	var lines []line
+	for i, text := range strings.Split(src, "\n") {
+		text = strings.TrimRight(stripYAMLComment(text), " \t\r")
+		if strings.TrimSpace(text) == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimLeft(text, " "), "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		trimmed := strings.TrimLeft(text, " ")
+		lines = append(lines, line{i + 1, len(text) - len(trimmed), trimmed})
+	}
+
+	pos := 0
+	var block func(indent int) (interface{}, error)
+	block = func(indent int) (interface{}, error) {
+		if strings.HasPrefix(lines[pos].text, "- ") || lines[pos].text == "-" {
+			var seq []interface{}
+			for pos < len(lines) && lines[pos].indent == indent && strings.HasPrefix(lines[pos].text, "-") {
+				l := lines[pos]
+				pos++
+				item := strings.TrimSpace(strings.TrimPrefix(l.text, "-"))
+				if item == "" || strings.Contains(item, ": ") || strings.HasSuffix(item, ":") {
+					return nil, fmt.Errorf("line %d: only sequences of scalars are supported", l.n)
+				}
+				v, err := yamlScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", l.n, err)
+				}
+				seq = append(seq, v)
+			}
+			return seq, nil
+		}
+
+		m := make(map[string]interface{})
+		for pos < len(lines) && lines[pos].indent == indent {
+			l := lines[pos]
+			pos++
+			i := strings.Index(l.text, ":")
+			if i < 0 || (i+1 < len(l.text) && l.text[i+1] != ' ') {
+				return nil, fmt.Errorf("line %d: want key: value", l.n)
+			}
+			key, value := strings.Trim(strings.TrimSpace(l.text[:i]), `"'`), strings.TrimSpace(l.text[i+1:])
+			if _, dup := m[key]; dup {
+				return nil, fmt.Errorf("line %d: duplicate key %q", l.n, key)
+			}
+			if value != "" {
+				v, err := yamlScalar(value)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", l.n, err)
+				}
+				m[key] = v
+				continue
+			}
+			if pos < len(lines) && (lines[pos].indent > indent || lines[pos].indent == indent && strings.HasPrefix(lines[pos].text, "-")) {
+				v, err := block(lines[pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+			} else {
+				m[key] = nil
+			}
+		}
+		return m, nil
+	}
+
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	v, err := block(lines[0].indent)
+	if err == nil && pos < len(lines) {
+		err = fmt.Errorf("line %d: bad indentation", lines[pos].n)
+	}
+	return v, err
+}
+
+//stripYAMLComment drops a # comment that is not inside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+//A yamlPlain is an unquoted scalar.  Whether it is a string, a number,
+//a boolean or null depends on the field it is decoded into.
+type yamlPlain string
+
+//typeYAML resolves the plain scalars in v, as parsed by parseYAML, for
+//decoding into a value of type t.  Those meant for string fields stay
+//strings, so a token like 0123 or on is kept as written; the rest
+//become booleans, numbers or null where they look like one.
+func typeYAML(v interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = typeYAML(item, fieldType(t, key))
+		}
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			elem = t.Elem()
+		}
+		for i, item := range v {
+			v[i] = typeYAML(item, elem)
+		}
+	case yamlPlain:
+		s := string(v)
+		switch {
+		case s == "null" || s == "~":
+			return nil
+		case t != nil && t.Kind() == reflect.String:
+			return s
+		}
+		switch s {
+		case "true", "yes", "on":
+			return true
+		case "false", "no", "off":
+			return false
+		}
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+		return s
+	}
+	return v
+}
+
+//fieldType returns the type of the field of struct type t with the
+//given json key, or nil.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name == key {
+			return f.Type
+		}
+	}
+	return nil
+}
+
+//yamlScalar converts a plain, quoted or [flow, sequence] value.
+func yamlScalar(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated sequence %s", s)
+		}
+		seq := []interface{}{}
+		if inner := strings.TrimSpace(s[1 : len(s)-1]); inner != "" {
+			for _, item := range strings.Split(inner, ",") {
+				v, err := yamlScalar(strings.TrimSpace(item))
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, v)
+			}
+		}
+		return seq, nil
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	return yamlPlain(s), nil
+}
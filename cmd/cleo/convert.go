@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//A termReader reads the terms in the given column out of a dump,
+//passing each to emit.  column is a name or a zero-based index.
+type termReader func(in io.Reader, column string, emit func(string)) error
+
+var termReaders = map[string]termReader{
+	"csv":   readCSVTerms,
+	"tsv":   readTSVTerms,
+	"json":  readJSONTerms,
+	"jsonl": readJSONLTerms,
+	"sql":   readSQLTerms,
+}
+
+//runConvert turns a dump into a corpus: one normalized term per line,
+//without duplicates.  Only the term column is kept, as a corpus line
+//is the whole document and has no room for payload columns.
+func runConvert(args []string) error {
+	fs := newFlagSet("convert")
+	format := fs.String("format", "", "csv, tsv, json, jsonl or sql; guessed from the file extension by default")
+	column := fs.String("column", "0", "name or zero-based index of the term column or field")
+	out := fs.String("out", "", "corpus file to write; stdout by default")
+	keepCase := fs.Bool("keep-case", false, "do not lowercase terms")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cleo convert [flags] dump")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("convert: one dump file is required")
+	}
+
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	read, ok := termReaders[*format]
+	if !ok {
+		return fmt.Errorf("convert: unknown format %q, use -format", *format)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+	}
+	bw := bufio.NewWriter(w)
+
+	seen := make(map[string]bool)
+	terms, dropped := 0, 0
+	err = read(bufio.NewReader(in), *column, func(term string) {
+		terms++
+		term = normalizeTerm(term, !*keepCase)
+		if term == "" || seen[term] {
+			dropped++
+			return
+		}
+		seen[term] = true
+		bw.WriteString(term)
+		bw.WriteByte('\n') //readCorpus only indexes terminated lines
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if w != os.Stdout {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("convert: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "read %d terms, wrote %d, dropped %d empty or duplicate\n", terms, len(seen), dropped)
+	return nil
+}
+
+//normalizeTerm trims a term and collapses runs of whitespace in it,
+//lowercasing it too if lower is set.
+func normalizeTerm(term string, lower bool) string {
+	term = strings.Join(strings.Fields(term), " ")
+	if lower {
+		term = strings.ToLower(term)
+	}
+	return term
+}
+
+func readCSVTerms(in io.Reader, column string, emit func(string)) error {
+	return readDelimitedTerms(csv.NewReader(in), column, emit)
+}
+
+func readTSVTerms(in io.Reader, column string, emit func(string)) error {
+	r := csv.NewReader(in)
+	r.Comma = '\t'
+	r.LazyQuotes = true
+	return readDelimitedTerms(r, column, emit)
+}
+
+//readDelimitedTerms picks the column by index, or by name from the
+//header row.  A header is only skipped when the column is named.
+func readDelimitedTerms(r *csv.Reader, column string, emit func(string)) error {
+	r.FieldsPerRecord = -1
+	idx, err := strconv.Atoi(column)
+	if err != nil {
+		header, err := r.Read()
+		if err != nil {
+			return err
+		}
+		if idx = indexOf(header, column); idx < 0 {
+			return fmt.Errorf("no column %q in header %q", column, header)
+		}
+	}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if idx < len(record) {
+			emit(record[idx])
+		}
+	}
+}
+
+//readJSONTerms reads an array of strings, or of objects holding the
+//term in the named field.
+func readJSONTerms(in io.Reader, column string, emit func(string)) error {
+	var values []json.RawMessage
+	if err := json.NewDecoder(in).Decode(&values); err != nil {
+		return err
+	}
+	for _, v := range values {
+		if err := emitJSONTerm(v, column, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//readJSONLTerms reads one string or object per line.
+func readJSONLTerms(in io.Reader, column string, emit func(string)) error {
+	dec := json.NewDecoder(in)
+	for {
+		var v json.RawMessage
+		if err := dec.Decode(&v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := emitJSONTerm(v, column, emit); err != nil {
+			return err
+		}
+	}
+}
+
+func emitJSONTerm(v json.RawMessage, field string, emit func(string)) error {
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		emit(s)
+		return nil
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(v, &obj); err != nil {
+		return fmt.Errorf("want strings or objects, got %s", v)
+	}
+	switch term := obj[field].(type) {
+	case string:
+		emit(term)
+	case float64:
+		emit(strconv.FormatFloat(term, 'f', -1, 64))
+	}
+	return nil
+}
+
+//readSQLTerms reads the rows of the INSERT statements in a SQL dump.
+//A named column is looked up in the statement's column list, or that
+//of the last statement that had one.
+func readSQLTerms(in io.Reader, column string, emit func(string)) error {
+	dump, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	p := &sqlParser{s: string(dump), mysql: isMySQLDump(string(dump))}
+	var columns []string
+	for p.nextInsert() {
+		if c := p.columnList(); c != nil {
+			columns = c
+		}
+		if !p.keyword("VALUES") {
+			return fmt.Errorf("INSERT without VALUES near offset %d", p.pos)
+		}
+		idx, err := strconv.Atoi(column)
+		if err != nil {
+			if idx = indexOf(columns, column); idx < 0 {
+				return fmt.Errorf("no column %q in INSERT columns %q", column, columns)
+			}
+		}
+		for {
+			row, err := p.tuple()
+			if err != nil {
+				return err
+			}
+			if idx < len(row) && row[idx] != nil {
+				emit(*row[idx])
+			}
+			if !p.punct(',') {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+//sqlParser understands just enough SQL to read INSERT ... VALUES rows
+//out of mysqldump and pg_dump --inserts output.
+type sqlParser struct {
+	s     string
+	pos   int
+	mysql bool //backslashes escape in strings, as they do not in standard SQL
+}
+
+//isMySQLDump tells mysqldump output, whose strings use backslash
+//escapes, from pg_dump output, whose strings are standard SQL.
+func isMySQLDump(dump string) bool {
+	return strings.Contains(dump, "-- MySQL dump") || strings.Contains(dump, "-- MariaDB dump") ||
+		strings.Contains(dump, "INSERT INTO `")
+}
+
+//nextInsert moves past the next INSERT INTO <table> that starts a
+//statement.  Comments, strings and quoted identifiers are skipped, so
+//an INSERT in a comment or a function body is not mistaken for one.
+func (p *sqlParser) nextInsert() bool {
+	const kw = "INSERT INTO"
+	start := p.pos == 0 //otherwise p is at the end of the previous INSERT's rows
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch {
+		case strings.IndexByte(" \t\r\n", c) >= 0:
+			p.pos++
+		case strings.HasPrefix(p.s[p.pos:], "--") || p.mysql && c == '#':
+			p.skipPast("\n")
+		case strings.HasPrefix(p.s[p.pos:], "/*"):
+			p.pos += 2
+			p.skipPast("*/")
+		case c == ';':
+			start = true
+			p.pos++
+		case start && len(p.s)-p.pos >= len(kw) && strings.EqualFold(p.s[p.pos:p.pos+len(kw)], kw):
+			p.pos += len(kw)
+			p.identifier()
+			return true
+		default:
+			start = false
+			p.skipToken()
+		}
+	}
+	return false
+}
+
+//skipPast moves past the next end, or to the end of the dump.
+func (p *sqlParser) skipPast(end string) {
+	if i := strings.Index(p.s[p.pos:], end); i >= 0 {
+		p.pos += i + len(end)
+	} else {
+		p.pos = len(p.s)
+	}
+}
+
+//skipToken moves past a quoted string or identifier, a PostgreSQL
+//dollar quoted string, or else a single byte.
+func (p *sqlParser) skipToken() {
+	switch c := p.s[p.pos]; {
+	case c == '\'':
+		escapes := p.mysql || p.pos > 0 && (p.s[p.pos-1] == 'E' || p.s[p.pos-1] == 'e')
+		p.quoted(escapes) //an unterminated string runs to the end
+	case c == '"' || c == '`':
+		for p.pos++; p.pos < len(p.s) && p.s[p.pos] != c; p.pos++ {
+			if p.mysql && c == '"' && p.s[p.pos] == '\\' {
+				p.pos++
+			}
+		}
+		if p.pos < len(p.s) {
+			p.pos++ //doubled quotes just read as two quoted names
+		}
+	case c == '$' && !p.mysql:
+		if tag := dollarTag(p.s[p.pos:]); tag != "" {
+			p.pos += len(tag)
+			p.skipPast(tag)
+			return
+		}
+		p.pos++
+	default:
+		p.pos++
+	}
+}
+
+//dollarTag returns the $tag$ or $$ opening s, if it opens a dollar
+//quoted string.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			return s[:i+1]
+		case c == '_' || c >= 0x80 || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 1 && '0' <= c && c <= '9':
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+func (p *sqlParser) space() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *sqlParser) punct(c byte) bool {
+	p.space()
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) keyword(kw string) bool {
+	p.space()
+	if len(p.s)-p.pos >= len(kw) && strings.EqualFold(p.s[p.pos:p.pos+len(kw)], kw) {
+		p.pos += len(kw)
+		return true
+	}
+	return false
+}
+
+//identifier reads a possibly quoted, possibly schema qualified name.
+func (p *sqlParser) identifier() string {
+	p.space()
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c == '`' || c == '"' {
+			if end := strings.IndexByte(p.s[p.pos+1:], c); end >= 0 {
+				p.pos += end + 2
+				continue
+			}
+		}
+		if c == ' ' || c == '(' || c == ',' || c == ')' || c == '\t' || c == '\n' || c == '\r' {
+			break
+		}
+		p.pos++
+	}
+	return strings.Trim(p.s[start:p.pos], "`\"")
+}
+
+//columnList reads an optional (a, b, c) list of column names.
+func (p *sqlParser) columnList() []string {
+	var columns []string
+	if !p.punct('(') {
+		return nil
+	}
+	for {
+		columns = append(columns, p.identifier())
+		if !p.punct(',') {
+			p.punct(')')
+			return columns
+		}
+	}
+}
+
+//tuple reads one (v1, v2, ...) row.  NULLs are nil.
+func (p *sqlParser) tuple() ([]*string, error) {
+	if !p.punct('(') {
+		return nil, fmt.Errorf("expected ( near offset %d", p.pos)
+	}
+	var row []*string
+	for {
+		p.space()
+		escapes := p.mysql
+		if p.pos+1 < len(p.s) && (p.s[p.pos] == 'E' || p.s[p.pos] == 'e') && p.s[p.pos+1] == '\'' {
+			p.pos++ //a PostgreSQL E'...' string, which takes backslash escapes
+			escapes = true
+		}
+		if p.pos < len(p.s) && p.s[p.pos] == '\'' {
+			s, err := p.quoted(escapes)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, &s)
+		} else {
+			start := p.pos
+			for p.pos < len(p.s) && p.s[p.pos] != ',' && p.s[p.pos] != ')' {
+				p.pos++
+			}
+			if v := strings.TrimSpace(p.s[start:p.pos]); strings.EqualFold(v, "NULL") {
+				row = append(row, nil)
+			} else {
+				row = append(row, &v)
+			}
+		}
+		if p.punct(')') {
+			return row, nil
+		}
+		if !p.punct(',') {
+			return nil, fmt.Errorf("expected , or ) near offset %d", p.pos)
+		}
+	}
+}
+
+//quoted reads a single quoted string, undoing '' and, with escapes,
+//backslash escapes.
+func (p *sqlParser) quoted(escapes bool) (string, error) {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.s); p.pos++ {
+		switch c := p.s[p.pos]; {
+		case escapes && c == '\\' && p.pos+1 < len(p.s):
+			p.pos++
+			switch e := p.s[p.pos]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '0':
+				b.WriteByte(0)
+			default:
+				b.WriteByte(e)
+			}
+		case c == '\'' && p.pos+1 < len(p.s) && p.s[p.pos+1] == '\'':
+			b.WriteByte('\'')
+			p.pos++
+		case c == '\'':
+			p.pos++
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if strings.EqualFold(n, name) {
+			return i
+		}
+	}
+	return -1
+}
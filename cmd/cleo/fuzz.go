@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jamra/gocleo"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+//runFuzz searches random corpora for random queries and compares the
+//results with a scan of the whole corpus.
+//
+//Two kinds of matches are checked.  Words the query is a prefix of
+//must always be returned, so missing one is a bug and fails the run.
+//Words within -distance edits of the query are what a fuzzy search
+//hopes to find; the share returned is reported as fuzzy recall.
+//
+//Queries shorter than the index's 4 character prefixes only reach the
+//bucket of words that short, so they are left out unless -min-query is
+//lowered; their misses are then reported but do not fail the run.
+func runFuzz(args []string) error {
+	fs := newFlagSet("fuzz")
+	seed := fs.Int64("seed", 0, "random seed; the current time by default")
+	rounds := fs.Int("rounds", 20, "number of corpora to generate")
+	words := fs.Int("words", 2000, "words per corpus")
+	queries := fs.Int("queries", 500, "queries per corpus")
+	alphabet := fs.String("alphabet", "abcdefgh", "letters words are made of; fewer letters give more collisions")
+	maxLen := fs.Int("max-len", 10, "longest generated word")
+	distance := fs.Int("distance", 1, "edit distance counted as a fuzzy match")
+	minQuery := fs.Int("min-query", shortQuery, "shortest query to try")
+	show := fs.Int("show", 10, "number of missed prefix matches to print")
+	fs.Parse(args)
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	if *maxLen < 1 || *alphabet == "" {
+		return fmt.Errorf("fuzz: -max-len and -alphabet must not be empty")
+	}
+	if *minQuery < 1 || *minQuery > *maxLen {
+		return fmt.Errorf("fuzz: -min-query must be between 1 and -max-len")
+	}
+
+	f := &fuzzer{rnd: rand.New(rand.NewSource(*seed)), alphabet: *alphabet, maxLen: *maxLen, minQuery: *minQuery}
+	var total fuzzTally
+	for round := 0; round < *rounds; round++ {
+		t, err := f.round(*words, *queries, *distance)
+		if err != nil {
+			return err
+		}
+		for _, miss := range t.misses {
+			if *show > 0 && len(miss[0]) >= shortQuery {
+				fmt.Printf("round %d: %q not returned for prefix query %q\n", round, miss[1], miss[0])
+				*show--
+			}
+		}
+		total.add(t)
+	}
+
+	fmt.Printf("seed %d, %d rounds, %d queries\n", *seed, *rounds, total.queries)
+	short := 0
+	for _, miss := range total.misses {
+		if len(miss[0]) < shortQuery {
+			short++
+		}
+	}
+	fmt.Printf("prefix matches  %d, missed %d (%d for queries under %d characters)\n", total.prefix, len(total.misses), short, shortQuery)
+	if total.fuzzy > 0 {
+		fmt.Printf("fuzzy recall    %.1f%% (%d of %d within distance %d)\n",
+			100*float64(total.fuzzyFound)/float64(total.fuzzy), total.fuzzyFound, total.fuzzy, *distance)
+	}
+	if len(total.misses) > short {
+		return fmt.Errorf("fuzz: %d prefix matches missed; rerun with -seed %d", len(total.misses)-short, *seed)
+	}
+	return nil
+}
+
+//shortQuery is the length of the prefixes the inverted index is keyed
+//by.  Shorter queries look up a bucket of their own length.
+const shortQuery = 4
+
+type fuzzer struct {
+	rnd      *rand.Rand
+	alphabet string
+	maxLen   int
+	minQuery int
+}
+
+type fuzzTally struct {
+	queries    int
+	prefix     int         //prefix matches expected
+	misses     [][2]string //query and word of prefix matches not returned
+	fuzzy      int         //fuzzy matches expected
+	fuzzyFound int
+}
+
+func (t *fuzzTally) add(o fuzzTally) {
+	t.queries += o.queries
+	t.prefix += o.prefix
+	t.misses = append(t.misses, o.misses...)
+	t.fuzzy += o.fuzzy
+	t.fuzzyFound += o.fuzzyFound
+}
+
+//round indexes a fresh random corpus and checks queries against it.
+func (f *fuzzer) round(words, queries, distance int) (fuzzTally, error) {
+	corpus := f.corpus(words)
+	file, err := os.CreateTemp("", "cleo-fuzz-*.txt")
+	if err != nil {
+		return fuzzTally{}, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(strings.Join(corpus, "\n") + "\n")
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fuzzTally{}, err
+	}
+	cleo.BuildIndexes(file.Name(), nil)
+	iIndex, fIndex := cleo.Indexes()
+
+	var t fuzzTally
+	for i := 0; i < queries; i++ {
+		query := f.query(corpus)
+		got := make(map[string]bool)
+		for _, r := range cleo.CleoSearch(iIndex, fIndex, query) {
+			got[r.Word] = true
+		}
+
+		t.queries++
+		for _, word := range corpus {
+			if strings.HasPrefix(word, query) {
+				t.prefix++
+				if !got[word] {
+					t.misses = append(t.misses, [2]string{query, word})
+				}
+			}
+			if levenshtein(query, word) <= distance {
+				t.fuzzy++
+				if got[word] {
+					t.fuzzyFound++
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+//corpus returns n distinct random words.
+func (f *fuzzer) corpus(n int) []string {
+	seen := make(map[string]bool)
+	words := make([]string, 0, n)
+	for tries := 0; len(words) < n && tries < 10*n; tries++ {
+		w := f.word(1 + f.rnd.Intn(f.maxLen))
+		if !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+func (f *fuzzer) word(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = f.alphabet[f.rnd.Intn(len(f.alphabet))]
+	}
+	return string(b)
+}
+
+//query returns a prefix of a corpus word, a corpus word with one edit,
+//or a random word, in that proportion, of at least minQuery letters.
+func (f *fuzzer) query(corpus []string) string {
+	for {
+		var q string
+		w := corpus[f.rnd.Intn(len(corpus))]
+		switch p := f.rnd.Intn(10); {
+		case p < 5:
+			q = w[:1+f.rnd.Intn(len(w))]
+		case p < 9:
+			q = f.edit(w)
+		default:
+			q = f.word(f.minQuery + f.rnd.Intn(f.maxLen-f.minQuery+1))
+		}
+		if len(q) >= f.minQuery {
+			return q
+		}
+	}
+}
+
+//edit inserts, deletes or substitutes one letter of w.
+func (f *fuzzer) edit(w string) string {
+	i := f.rnd.Intn(len(w) + 1)
+	c := f.word(1)
+	switch f.rnd.Intn(3) {
+	case 0:
+		return w[:i] + c + w[i:]
+	case 1:
+		if len(w) > 1 && i < len(w) {
+			return w[:i] + w[i+1:]
+		}
+	}
+	if i == len(w) {
+		i--
+	}
+	return w[:i] + c + w[i+1:]
+}
+
+//levenshtein is the textbook edit distance the reference scan uses.
+func levenshtein(s, t string) int {
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = cleo.Min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(t)]
+}
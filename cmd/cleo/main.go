@@ -0,0 +1,126 @@
+// Command cleo builds, searches and serves gocleo indexes.
+//
+//	cleo convert -column word -out words.txt dump.csv
+//	cleo build -corpus words.txt -out index.cleo [-scorer prefix]
+//	cleo search -index index.cleo [query ...]
+//	cleo serve -index index.cleo -addr :9999
+//	cleo repl -index index.cleo
+//	cleo bench -index index.cleo -queries q.txt -concurrency 16
+//	cleo migrate index.cleo
+//
+// search and serve take either a snapshot written by build with -index
+// or a corpus to index on startup with -corpus.  Both can be http(s),
+// s3 or gs URLs as well as files.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/jamra/gocleo"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A command is one cleo subcommand.  run gets the arguments after the
+// subcommand name.
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"bench":   {"replay a query log and report latency per scorer", runBench},
+	"build":   {"index a corpus into a snapshot file", runBuild},
+	"convert": {"turn a CSV, JSON or SQL dump into a corpus", runConvert},
+	"fuzz":    {"check search recall against a scan of random corpora", runFuzz},
+	"migrate": {"rewrite old snapshot files in the current format", runMigrate},
+	"repl":    {"explore an index interactively", runRepl},
+	"search":  {"query an index once or interactively", runSearch},
+	"serve":   {"serve an index over HTTP", runServe},
+	"verify":  {"check snapshot files for corruption", runVerify},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: cleo <command> [flags]\n\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun cleo <command> -h for the flags of a command.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cleo: unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "cleo:", err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet returns the flag set of a subcommand, exiting on bad flags.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("cleo "+name, flag.ExitOnError)
+}
+
+// indexFlags adds the -index and -corpus flags choosing what to load.
+func indexFlags(fs *flag.FlagSet) (index, corpus *string) {
+	index = fs.String("index", "", "snapshot file or URL written by cleo build")
+	corpus = fs.String("corpus", "", "corpus file or URL to index on startup, one word per line")
+	return
+}
+
+// loadIndex starts serving the snapshot at index, or else the corpus.
+func loadIndex(index, corpus string) (cleo.BuildStats, error) {
+	switch {
+	case index != "" && corpus != "":
+		return cleo.BuildStats{}, fmt.Errorf("-index and -corpus are exclusive")
+	case isURL(index):
+		return cleo.LoadFrom(context.Background(), index, nil)
+	case index != "":
+		file, err := os.Open(index)
+		if err != nil {
+			return cleo.BuildStats{}, err
+		}
+		defer file.Close()
+		return cleo.LoadIndexes(file)
+	case corpus != "":
+		return buildIndex(corpus, nil)
+	}
+	return cleo.BuildStats{}, fmt.Errorf("one of -index or -corpus is required")
+}
+
+// buildIndex indexes corpus with score, reporting a missing file as an
+// error rather than letting BuildIndexes exit.
+func buildIndex(corpus string, score func(query, candidate string) float64) (cleo.BuildStats, error) {
+	if isURL(corpus) {
+		return cleo.LoadFrom(context.Background(), corpus, score)
+	}
+	if _, err := os.Stat(corpus); err != nil {
+		return cleo.BuildStats{}, err
+	}
+	start := time.Now()
+	cleo.BuildIndexes(corpus, score)
+	iIndex, fIndex := cleo.Indexes()
+	return cleo.BuildStats{Documents: len(*fIndex), Prefixes: iIndex.Size(), Took: time.Since(start)}, nil
+}
+
+// isURL tells locations cleo.LoadFrom fetches from file names.
+func isURL(location string) bool {
+	return strings.Contains(location, "://")
+}
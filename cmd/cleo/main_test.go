@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jamra/gocleo"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestReadSQLTerms(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		dump   string
+		column string
+		want   []string
+	}{
+		{
+			name: "mysqldump",
+			dump: "-- MySQL dump 10.13  Distrib 8.0.36, for Linux (x86_64)\n" +
+				"--\n-- Host: localhost    Database: shop\n" +
+				"/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;\n" +
+				"DROP TABLE IF EXISTS `products`;\n" +
+				"CREATE TABLE `products` (\n  `id` int NOT NULL AUTO_INCREMENT,\n  `name` varchar(255) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n" +
+				"LOCK TABLES `products` WRITE;\n" +
+				"INSERT INTO `products` VALUES (1,'Tractor'),(2,'O\\'Brien\\'s Pizza'),(3,'C:\\\\new'),(4,NULL);\n" +
+				"UNLOCK TABLES;\n",
+			column: "1",
+			want:   []string{"Tractor", "O'Brien's Pizza", `C:\new`},
+		},
+		{
+			name: "mysqldump --complete-insert",
+			dump: "-- MariaDB dump 10.19  Distrib 10.11.6-MariaDB\n" +
+				"INSERT INTO `products` (`id`, `name`) VALUES (1,'tab\\there'),(2,'it''s');\n",
+			column: "name",
+			want:   []string{"tab\there", "it's"},
+		},
+		{
+			name: "pg_dump --inserts",
+			dump: "--\n-- PostgreSQL database dump\n--\n\n" +
+				"SET standard_conforming_strings = on;\n" +
+				"INSERT INTO public.products VALUES (1, 'Tractor');\n" +
+				"INSERT INTO public.products VALUES (2, 'C:\\new');\n" +
+				"INSERT INTO public.products VALUES (3, 'it''s');\n" +
+				"INSERT INTO public.products VALUES (4, E'tab\\there');\n",
+			column: "1",
+			want:   []string{"Tractor", `C:\new`, "it's", "tab\there"},
+		},
+		{
+			name: "pg_dump --column-inserts",
+			dump: "-- PostgreSQL database dump\n" +
+				"INSERT INTO public.products (id, name) VALUES (1, 'Nightingale');\n" +
+				"insert into public.products (id, name) values (2, NULL);\n",
+			column: "name",
+			want:   []string{"Nightingale"},
+		},
+		{
+			name: "mysqldump INSERT INTO in comments and strings",
+			dump: "-- MySQL dump 10.13\n" +
+				"-- INSERT INTO `products` VALUES (9,'line comment');\n" +
+				"/*!40101 SET NAMES utf8mb4 */;\n/* INSERT INTO `products` VALUES (9,'block comment') */\n" +
+				"INSERT INTO `products` VALUES (1,'say \\'INSERT INTO\\' here'),(2,'Tractor');\n" +
+				"UPDATE `notes` SET body='INSERT INTO `products` VALUES (9,\\'string\\')';\n" +
+				"# INSERT INTO `products` VALUES (9,'hash comment')\n" +
+				"-- INSERT INTO `products` VALUES (9,'after the last statement')\n",
+			column: "1",
+			want:   []string{"say 'INSERT INTO' here", "Tractor"},
+		},
+		{
+			name: "pg_dump INSERT INTO in function bodies, rules and strings",
+			dump: "-- PostgreSQL database dump\n" +
+				"CREATE FUNCTION audit() RETURNS trigger AS $body$\nBEGIN\n" +
+				"  INSERT INTO audit VALUES (NEW.id, 'changed');\n  RETURN NEW;\nEND $body$ LANGUAGE plpgsql;\n" +
+				"CREATE FUNCTION one() RETURNS void AS $$ INSERT INTO audit VALUES (1, 'plain') $$ LANGUAGE sql;\n" +
+				"CREATE RULE copy AS ON INSERT TO products DO ALSO INSERT INTO archive VALUES (NEW.id, NEW.name);\n" +
+				"COMMENT ON TABLE products IS 'INSERT INTO products VALUES (9, ''string'');';\n" +
+				"INSERT INTO public.products VALUES (1, 'Tractor');\n" +
+				"/* INSERT INTO public.products VALUES (9, 'block comment') */\n" +
+				"-- INSERT INTO public.products VALUES (9, 'after the last statement')\n",
+			column: "1",
+			want:   []string{"Tractor"},
+		},
+		{
+			name:   "invalid UTF-8 before the inserts",
+			dump:   "-- \xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\nINSERT INTO t VALUES (1, 'pizza');\n",
+			column: "1",
+			want:   []string{"pizza"},
+		},
+	} {
+		var got []string
+		err := readSQLTerms(strings.NewReader(tc.dump), tc.column, func(term string) { got = append(got, term) })
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestReadServeConfigYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cleo.yaml")
+	src := `# served from a snapshot
+addr: ":8080"
+index: index.cleo   # not the corpus
+scorer: prefix
+refetch: 30
+limits:
+  read_timeout: 10s
+  max_limit: 100
+  rate_limit: 2.5
+cors:
+  origins: [https://example.com, 'https://other.example.com']
+auth:
+  tokens:
+    - 0123
+    - on
+    - "quoted # not a comment"
+metrics:
+  access_log: yes
+  slow_query: 50ms
+`
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := readServeConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != ":8080" || c.Index != "index.cleo" || c.Scorer != "prefix" {
+		t.Errorf("got addr %q, index %q, scorer %q", c.Addr, c.Index, c.Scorer)
+	}
+	if c.Refetch == nil || time.Duration(*c.Refetch) != 30*time.Second {
+		t.Errorf("got refetch %v, want 30s", c.Refetch)
+	}
+	l := c.Limits
+	if l.ReadTimeout == nil || time.Duration(*l.ReadTimeout) != 10*time.Second || l.MaxLimit == nil || *l.MaxLimit != 100 || l.RateLimit != 2.5 {
+		t.Errorf("got limits %+v", l)
+	}
+	if want := []string{"https://example.com", "https://other.example.com"}; !reflect.DeepEqual(c.CORS.Origins, want) {
+		t.Errorf("got origins %q, want %q", c.CORS.Origins, want)
+	}
+	if want := []string{"0123", "on", "quoted # not a comment"}; !reflect.DeepEqual(c.Auth.Tokens, want) {
+		t.Errorf("got tokens %q, want %q", c.Auth.Tokens, want)
+	}
+	if !c.Metrics.AccessLog || c.Metrics.SlowQuery == nil || time.Duration(*c.Metrics.SlowQuery) != 50*time.Millisecond {
+		t.Errorf("got metrics %+v", c.Metrics)
+	}
+}
+
+func TestReadServeConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	for i, src := range []string{
+		"addr: :8080\nadr: :9090\n",          //unknown key
+		"addr: a\naddr: b\n",                 //duplicate key
+		"limits:\n\tmax_limit: 1\n",          //tab indentation
+		"limits:\n  max_limit: 1\n bad: 2\n", //bad indentation
+		"cors:\n  origins: [a, b\n",          //unterminated sequence
+		"auth:\n  tokens:\n    - a: b\n",     //sequence of mappings
+		"limits:\n  max_limit: lots\n",       //not a number
+		"tls:\n  cert: \"unterminated\n",     //unterminated string
+		"prefix_len: 4\n",                    //no longer a setting
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("%d.yaml", i))
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readServeConfig(path); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+}
+
+func TestServeConfigValidate(t *testing.T) {
+	refetch := duration(time.Minute)
+	for _, tc := range []struct {
+		name string
+		c    serveConfig
+		ok   bool
+	}{
+		{"index", serveConfig{Index: "index.cleo"}, true},
+		{"refetch of a URL", serveConfig{Index: "https://example.com/index.cleo", Refetch: &refetch}, true},
+		{"refetch of a file", serveConfig{Index: "index.cleo", Refetch: &refetch}, false},
+		{"WAL without an index", serveConfig{Corpus: "words.txt", WAL: "cleo.wal"}, false},
+		{"unknown scorer", serveConfig{Corpus: "words.txt", Scorer: "nope"}, false},
+	} {
+		if err := tc.c.validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+
+	var c serveConfig
+	c.TLS.ClientCA = "ca.pem"
+	if err := c.validate(); err == nil {
+		t.Error("tls.client_ca without a certificate: no error")
+	}
+	c.TLS.Cert = "server.pem"
+	if err := c.validate(); err == nil {
+		t.Error("tls.cert without tls.key: no error")
+	}
+	c.TLS.Key = "server.key"
+	if err := c.validate(); err != nil {
+		t.Errorf("tls with client_ca: %v", err)
+	}
+
+	c = serveConfig{}
+	c.Limits.RateLimit = -1
+	if err := c.validate(); err == nil {
+		t.Error("negative rate_limit: no error")
+	}
+}
+
+func TestReplExplain(t *testing.T) {
+	if _, err := cleo.LoadFromFS(fstest.MapFS{"words.txt": {Data: []byte("apple\napply\n")}}, "words.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	r := &repl{out: &out, limit: 10}
+	if err := r.run(strings.NewReader("explain -foo apple\nexplain -ap -pl apple\nexplain appl apple\n")); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	if strings.Count(got, "has no terms to search for") != 2 || !strings.Contains(got, "returned   yes") {
+		t.Errorf("got %q", got)
+	}
+}
+
+//runCommand runs a subcommand with stdin read from the given text,
+//returning what it printed to stdout.
+func runCommand(t *testing.T, run func(args []string) error, args []string, stdin string) (string, error) {
+	dir := t.TempDir()
+	in, err := os.Create(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if _, err := in.WriteString(stdin); err != nil {
+		t.Fatal(err)
+	}
+	in.Seek(0, 0)
+	out, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	oldIn, oldOut := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = in, out
+	err = run(args)
+	os.Stdin, os.Stdout = oldIn, oldOut
+
+	printed, rerr := os.ReadFile(out.Name())
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return string(printed), err
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	corpus := write("words.txt", "apple\napply\napricot\nbanana\n")
+	queries := write("queries.txt", "appl\n\nbanan\n")
+	empty := write("empty.txt", "\n")
+	corrupt := write("corrupt.cleo", "CLEO\x01garbage")
+	snapshot := filepath.Join(dir, "index.cleo")
+	migrated := filepath.Join(dir, "migrated.cleo")
+	missing := filepath.Join(dir, "missing.txt")
+
+	//Taking the port makes serve fail only once the index is loaded
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	for _, tc := range []struct {
+		name  string
+		run   func(args []string) error
+		args  []string
+		stdin string
+		want  []string //printed to stdout
+		err   string   //in the error returned, if any
+	}{
+		{name: "build", run: runBuild, args: []string{"-corpus", corpus, "-out", snapshot, "-scorer", "prefix"},
+			want: []string{"documents  4\n", "scorer     prefix\n", "wrote      " + snapshot}},
+		{name: "build without corpus", run: runBuild, args: []string{"-out", snapshot}, err: "-corpus is required"},
+		{name: "build missing corpus", run: runBuild, args: []string{"-corpus", missing, "-out", snapshot}, err: "no such file"},
+		{name: "build unknown scorer", run: runBuild, args: []string{"-corpus", corpus, "-scorer", "nope"}, err: `unknown scorer "nope"`},
+
+		{name: "search", run: runSearch, args: []string{"-index", snapshot, "apri"}, want: []string{"\tapricot\n"}},
+		{name: "search stdin", run: runSearch, args: []string{"-corpus", corpus, "-n", "1"}, stdin: "bana\n\nappl\n",
+			want: []string{"\tbanana\n"}},
+		{name: "search index and corpus", run: runSearch, args: []string{"-index", snapshot, "-corpus", corpus, "x"}, err: "exclusive"},
+		{name: "search nothing to load", run: runSearch, args: []string{"x"}, err: "one of -index or -corpus"},
+		{name: "search missing index", run: runSearch, args: []string{"-index", missing, "x"}, err: "no such file"},
+
+		{name: "bench", run: runBench, args: []string{"-index", snapshot, "-queries", queries, "-scorers", "fuzzy, prefix", "-concurrency", "2"},
+			want: []string{"scorer", "fuzzy", "prefix"}},
+		{name: "bench without queries", run: runBench, args: []string{"-index", snapshot}, err: "-queries is required"},
+		{name: "bench no concurrency", run: runBench, args: []string{"-index", snapshot, "-queries", queries, "-concurrency", "0"}, err: "-concurrency"},
+		{name: "bench empty queries", run: runBench, args: []string{"-index", snapshot, "-queries", empty}, err: "no queries"},
+		{name: "bench unknown scorer", run: runBench, args: []string{"-index", snapshot, "-queries", queries, "-scorers", "nope"}, err: `unknown scorer "nope"`},
+
+		{name: "repl", run: runRepl, args: []string{"-index", snapshot, "-no-color"}, stdin: "apri\nexplain -foo apple\nstats\n",
+			want: []string{"loaded 4 documents", "apricot", "has no terms to search for"}},
+		{name: "repl missing index", run: runRepl, args: []string{"-index", missing}, err: "no such file"},
+
+		{name: "fuzz", run: runFuzz, args: []string{"-seed", "1", "-rounds", "2", "-words", "50", "-queries", "10"},
+			want: []string{"seed 1, 2 rounds, 20 queries\n", "prefix matches"}},
+		{name: "fuzz min-query", run: runFuzz, args: []string{"-seed", "1", "-min-query", "0"}, err: "-min-query"},
+		{name: "fuzz max-len", run: runFuzz, args: []string{"-seed", "1", "-max-len", "0"}, err: "-max-len"},
+
+		{name: "verify", run: runVerify, args: []string{snapshot}, want: []string{snapshot + ": 4 documents", "scorer prefix\n"}},
+		{name: "verify corrupt", run: runVerify, args: []string{snapshot, corrupt}, want: []string{corrupt + ": "},
+			err: "1 of 2 snapshots are corrupt"},
+		{name: "verify nothing", run: runVerify, err: "no snapshot given"},
+
+		{name: "migrate current", run: runMigrate, args: []string{snapshot}, want: []string{snapshot + ": already version 1\n"}},
+		{name: "migrate out", run: runMigrate, args: []string{"-out", migrated, snapshot},
+			want: []string{"version 1 migrated to 1 in " + migrated}},
+		{name: "migrate corrupt", run: runMigrate, args: []string{corrupt}, err: "migrate: " + corrupt},
+		{name: "migrate nothing", run: runMigrate, err: "no snapshot given"},
+		{name: "migrate out of two", run: runMigrate, args: []string{"-out", migrated, snapshot, snapshot}, err: "single snapshot"},
+
+		{name: "serve trace", run: runServe, args: []string{"-index", snapshot, "-trace", dir, "-trace-every", "10s", "-trace-cpu", "1m"},
+			err: "-trace-cpu"},
+		{name: "serve wal without index", run: runServe, args: []string{"-corpus", corpus, "-wal", filepath.Join(dir, "wal")},
+			err: "WAL needs the snapshot"},
+		{name: "serve missing config", run: runServe, args: []string{"-config", missing}, err: "no such file"},
+		{name: "serve missing index", run: runServe, args: []string{"-index", missing, "-addr", busy.Addr().String()}, err: "no such file"},
+		{name: "serve address in use", run: runServe, args: []string{"-index", snapshot, "-addr", busy.Addr().String()}, err: "in use"},
+	} {
+		out, err := runCommand(t, tc.run, tc.args, tc.stdin)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: error %v, want one containing %q", tc.name, err, tc.err)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: printed %q, want %q in it", tc.name, out, want)
+			}
+		}
+	}
+
+	saved, _ := os.ReadFile(snapshot)
+	copied, _ := os.ReadFile(migrated)
+	if len(saved) == 0 || !bytes.Equal(saved, copied) {
+		t.Errorf("migrate -out wrote %d bytes, want the %d of the snapshot", len(copied), len(saved))
+	}
+}
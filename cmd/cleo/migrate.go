@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jamra/gocleo"
+	"os"
+	"path/filepath"
+)
+
+//runMigrate rewrites snapshots saved by older versions of cleo in the
+//current format, so they need not be rebuilt from their corpora.
+//Files are replaced in place unless -out is given.
+func runMigrate(args []string) error {
+	fs := newFlagSet("migrate")
+	out := fs.String("out", "", "file to write the migrated snapshot to; replaces the input by default")
+	force := fs.Bool("force", false, "rewrite snapshots already in the current format")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cleo migrate [flags] index.cleo ...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("migrate: no snapshot given")
+	}
+	if *out != "" && fs.NArg() != 1 {
+		return fmt.Errorf("migrate: -out takes a single snapshot")
+	}
+
+	for _, path := range fs.Args() {
+		dst := *out
+		if dst == "" {
+			dst = path
+		}
+		if err := migrateFile(path, dst, *force); err != nil {
+			return fmt.Errorf("migrate: %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+//migrateFile writes the migrated snapshot next to dst and renames it
+//into place, so a failure leaves the original untouched.
+func migrateFile(src, dst string, force bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	bw := bufio.NewWriter(tmp)
+	version, err := cleo.MigrateSnapshot(bw, bufio.NewReader(in))
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(fi.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if version == cleo.CurrentSnapshotVersion && dst == src && !force {
+		fmt.Printf("%s: already version %d\n", src, version)
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	fmt.Printf("%s: version %d migrated to %d in %s\n", src, version, cleo.CurrentSnapshotVersion, dst)
+	return nil
+}
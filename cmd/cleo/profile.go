@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	runtimepprof "runtime/pprof"
+	"strings"
+	"time"
+)
+
+//pprofMux serves net/http/pprof on the admin address only.
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+//hidePprof keeps the handlers net/http/pprof registers on
+//http.DefaultServeMux off the public address.
+func hidePprof(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/pprof") {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+//captureProfiles writes a CPU profile of cpu and a heap profile into
+//dir every interval until ctx is done.
+func captureProfiles(ctx context.Context, dir string, every, cpu time.Duration) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("profiles: %v", err)
+		return
+	}
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		stamp := time.Now().UTC().Format("20060102T150405Z")
+		if err := writeCPUProfile(ctx, filepath.Join(dir, "cpu-"+stamp+".pprof"), cpu); err != nil {
+			log.Printf("profiles: %v", err)
+		}
+		if err := writeProfile(filepath.Join(dir, "heap-"+stamp+".pprof"), "heap"); err != nil {
+			log.Printf("profiles: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func writeCPUProfile(ctx context.Context, path string, d time.Duration) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := runtimepprof.StartCPUProfile(file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("cpu profile: %v", err) //most likely /debug/pprof/profile is running
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+	runtimepprof.StopCPUProfile()
+	return file.Close()
+}
+
+func writeProfile(path, name string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := runtimepprof.Lookup(name).WriteTo(file, 0); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
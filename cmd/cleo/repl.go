@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jamra/gocleo"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+//ANSI escapes used to highlight the matching part of results.
+const (
+	colorMatch = "\x1b[1;32m"
+	colorDim   = "\x1b[2m"
+	colorReset = "\x1b[0m"
+)
+
+//A repl reads commands from stdin and writes their output to out.
+type repl struct {
+	out   io.Writer
+	limit int
+	color bool
+}
+
+type replCommand struct {
+	usage string
+	run   func(r *repl, args []string)
+}
+
+var replCommands map[string]replCommand
+
+func init() {
+	replCommands = map[string]replCommand{
+		"search":  {"search <query>              rank with the index's scorer", (*repl).search},
+		"fuzzy":   {"fuzzy <query>               rank with the fuzzy scorer", (*repl).fuzzy},
+		"explain": {"explain <query> <candidate>  show how the query treats a candidate", (*repl).explain},
+		"stats":   {"stats                       show index and query statistics", (*repl).stats},
+		"help":    {"help                        list the commands", (*repl).help},
+	}
+}
+
+//runRepl loads an index and reads commands until EOF or quit.  A line
+//that is not a command is searched for.
+func runRepl(args []string) error {
+	fs := newFlagSet("repl")
+	index, corpus := indexFlags(fs)
+	limit := fs.Int("n", 10, "number of results to print per query")
+	noColor := fs.Bool("no-color", false, "do not highlight matches")
+	fs.Parse(args)
+
+	stats, err := loadIndex(*index, *corpus)
+	if err != nil {
+		return err
+	}
+
+	r := &repl{out: os.Stdout, limit: *limit, color: !*noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)}
+	fmt.Fprintf(r.out, "loaded %d documents in %v; type help for commands\n", stats.Documents, stats.Took)
+	return r.run(os.Stdin)
+}
+
+//run executes the commands read from stdin.
+func (r *repl) run(stdin io.Reader) error {
+	in := bufio.NewScanner(stdin)
+	for fmt.Fprint(r.out, "cleo> "); in.Scan(); fmt.Fprint(r.out, "cleo> ") {
+		fields := strings.Fields(in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return nil
+		}
+		if cmd, ok := replCommands[fields[0]]; ok {
+			cmd.run(r, fields[1:])
+		} else {
+			r.search(fields)
+		}
+	}
+	fmt.Fprintln(r.out)
+	return in.Err()
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (r *repl) search(args []string) {
+	iIndex, fIndex := cleo.Indexes()
+	r.printSuggestions(cleo.Suggest(iIndex, fIndex, strings.Join(args, " "), r.limit))
+}
+
+func (r *repl) fuzzy(args []string) {
+	iIndex, fIndex := cleo.Indexes()
+	r.printSuggestions(cleo.SuggestWith(iIndex, fIndex, strings.Join(args, " "), r.limit, cleo.Score))
+}
+
+func (r *repl) printSuggestions(suggestions []cleo.Suggestion) {
+	if len(suggestions) == 0 {
+		fmt.Fprintln(r.out, r.paint(colorDim, "no results"))
+		return
+	}
+	for _, s := range suggestions {
+		fmt.Fprintf(r.out, "%.4f  %s\n", s.Score, r.highlight(s.Word, s.Highlight))
+	}
+}
+
+//highlight colors the spans of word that matched the query.
+func (r *repl) highlight(word string, spans [][2]int) string {
+	if !r.color {
+		return word
+	}
+	var b strings.Builder
+	at := 0
+	for _, span := range spans {
+		start, end := cleo.Min(span[0], len(word)), cleo.Min(span[1], len(word))
+		if start < at {
+			continue
+		}
+		b.WriteString(word[at:start])
+		b.WriteString(r.paint(colorMatch, word[start:end]))
+		at = end
+	}
+	b.WriteString(word[at:])
+	return b.String()
+}
+
+func (r *repl) paint(color, s string) string {
+	if !r.color || s == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+func (r *repl) explain(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintln(r.out, "usage:", replCommands["explain"].usage)
+		return
+	}
+	iIndex, fIndex := cleo.Indexes()
+	query, candidate := strings.Join(args[:len(args)-1], " "), args[len(args)-1]
+	if !hasSearchTerms(query) {
+		fmt.Fprintf(r.out, "query %q has no terms to search for\n", query)
+		return
+	}
+	e := cleo.Explain(iIndex, fIndex, query, candidate)
+
+	fmt.Fprintf(r.out, "query      %q rewritten to %q, prefix %q\n", e.Query, e.Rewritten, e.Prefix)
+	if len(e.Excluded) > 0 {
+		fmt.Fprintf(r.out, "excluded   %s\n", strings.Join(e.Excluded, ", "))
+	}
+	fmt.Fprintf(r.out, "in bucket  %s\n", r.yesNo(e.InBucket))
+	fmt.Fprintf(r.out, "bloom      %s\n", r.yesNo(e.BloomPass))
+	if e.ExcludedBy != "" {
+		fmt.Fprintf(r.out, "excluded   by %q\n", e.ExcludedBy)
+	}
+	fmt.Fprintf(r.out, "distance   %d\n", e.Distance)
+	fmt.Fprintf(r.out, "score      %.4f (%s)\n", e.Score, e.Scorer)
+	fmt.Fprintf(r.out, "returned   %s\n", r.yesNo(e.Returned))
+}
+
+//hasSearchTerms reports whether query has a term that is not negated.
+func hasSearchTerms(query string) bool {
+	for _, term := range strings.Fields(query) {
+		if len(term) == 1 || term[0] != '-' {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *repl) yesNo(b bool) string {
+	if b {
+		return r.paint(colorMatch, "yes")
+	}
+	return r.paint(colorDim, "no")
+}
+
+func (r *repl) stats(args []string) {
+	st := cleo.CurrentStats()
+	fmt.Fprintf(r.out, "documents  %d\n", st.Documents)
+	fmt.Fprintf(r.out, "prefixes   %d\n", st.Prefixes)
+	fmt.Fprintf(r.out, "queries    %d\n", st.Queries)
+	fmt.Fprintf(r.out, "latency    p50 %.3fms  p95 %.3fms  p99 %.3fms\n", st.LatencyP50Ms, st.LatencyP95Ms, st.LatencyP99Ms)
+	fmt.Fprintf(r.out, "bloom      %.1f%% of candidates rejected\n", 100*st.BloomRejectRatio)
+}
+
+func (r *repl) help(args []string) {
+	names := make([]string, 0, len(replCommands))
+	for name := range replCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(r.out, "  "+replCommands[name].usage)
+	}
+	fmt.Fprintln(r.out, "  quit")
+	fmt.Fprintln(r.out, "Any other line is searched for.")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jamra/gocleo"
+	"os"
+	"sort"
+	"strings"
+)
+
+//runSearch prints the results of the query given as arguments, or
+//with none reads queries from stdin one per line.
+func runSearch(args []string) error {
+	fs := newFlagSet("search")
+	index, corpus := indexFlags(fs)
+	limit := fs.Int("n", 10, "number of results to print per query")
+	fs.Parse(args)
+
+	if _, err := loadIndex(*index, *corpus); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		printResults(strings.Join(fs.Args(), " "), *limit)
+		return nil
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	for prompt(); in.Scan(); prompt() {
+		if query := strings.TrimSpace(in.Text()); query != "" {
+			printResults(query, *limit)
+		}
+	}
+	return in.Err()
+}
+
+//prompt is only shown when stdin is a terminal, so piped queries give
+//clean output.
+func prompt() {
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		fmt.Print("> ")
+	}
+}
+
+func printResults(query string, limit int) {
+	iIndex, fIndex := cleo.Indexes()
+	rslt := cleo.CleoSearch(iIndex, fIndex, query)
+	sort.Sort(cleo.ByScore{RankedResults: rslt})
+	if limit >= 0 && len(rslt) > limit {
+		rslt = rslt[:limit]
+	}
+	for _, r := range rslt {
+		fmt.Printf("%.4f\t%s\n", r.Score, r.Word)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/jamra/gocleo"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//runServe serves an index on the cleo endpoints until interrupted,
+//letting in-flight requests finish.  Flags given on the command line
+//override the config file.
+func runServe(args []string) error {
+	fs := newFlagSet("serve")
+	index, corpus := indexFlags(fs)
+	addr := fs.String("addr", ":9999", "address to listen on")
+	configPath := fs.String("config", "", "YAML or JSON config file")
+	walPath := fs.String("wal", "", "write-ahead log keeping admin updates; checkpoints rewrite the -index snapshot")
+	checkpoint := fs.Duration("checkpoint", 5*time.Minute, "how often to checkpoint the -wal log into the snapshot")
+	refetch := fs.Duration("refetch", 0, "how often to reload an -index or -corpus URL, serving it again when it changed")
+	pprofAddr := fs.String("pprof", "", "address to serve net/http/pprof on, such as localhost:6060")
+	traceDir := fs.String("trace", "", "directory to write periodic CPU and heap profiles to")
+	traceEvery := fs.Duration("trace-every", 10*time.Minute, "how often to write profiles with -trace")
+	traceCPU := fs.Duration("trace-cpu", 30*time.Second, "how long each CPU profile written with -trace runs")
+	fs.Parse(args)
+	if *traceDir != "" && (*traceEvery <= 0 || *traceCPU <= 0 || *traceCPU > *traceEvery) {
+		return fmt.Errorf("serve: -trace-cpu must be positive and no longer than -trace-every")
+	}
+
+	c := new(serveConfig)
+	if *configPath != "" {
+		var err error
+		if c, err = readServeConfig(*configPath); err != nil {
+			return err
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "index", "corpus":
+			c.Index, c.Corpus = *index, *corpus
+		case "addr":
+			c.Addr = *addr
+		case "wal":
+			c.WAL = *walPath
+		case "checkpoint":
+			d := duration(*checkpoint)
+			c.Checkpoint = &d
+		case "refetch":
+			d := duration(*refetch)
+			c.Refetch = &d
+		}
+	})
+	if c.Addr == "" {
+		c.Addr = *addr
+	}
+	location := c.Index
+	if location == "" {
+		location = c.Corpus
+	}
+	//Everything that can be checked is, before anything starts
+	if err := c.validate(); err != nil {
+		return err
+	}
+	server := cleo.NewServer(c.Addr, c.serverOptions(cleo.DefaultServerOptions))
+	server.Handler = hidePprof(http.DefaultServeMux)
+	var err error
+	if c.TLS.ClientCA != "" {
+		if server.TLSConfig, err = cleo.ClientCertConfig(c.TLS.ClientCA); err != nil {
+			return err
+		}
+	}
+	if err := c.install(); err != nil {
+		return err
+	}
+
+	var stats cleo.BuildStats
+	var score func(query, candidate string) float64
+	if c.Scorer != "" && c.Corpus != "" && c.Index == "" {
+		if score, err = cleo.LookupScorer(c.Scorer); err != nil {
+			return fmt.Errorf("serve: %v", err)
+		}
+		stats, err = buildIndex(c.Corpus, score)
+	} else {
+		stats, err = loadIndex(c.Index, c.Corpus)
+	}
+	if err != nil {
+		return err
+	}
+	if c.WAL != "" {
+		wal, err := cleo.OpenWAL(c.Index, c.WAL)
+		if err != nil {
+			return err
+		}
+		defer wal.Close()
+		every := *checkpoint
+		if c.Checkpoint != nil {
+			every = time.Duration(*c.Checkpoint)
+		}
+		if every > 0 {
+			wal.CheckpointEvery(every)
+		}
+	}
+
+	fetching, stopFetching := context.WithCancel(context.Background())
+	defer stopFetching()
+	if c.Refetch != nil && *c.Refetch > 0 {
+		cleo.RefetchEvery(fetching, location, time.Duration(*c.Refetch), score)
+	}
+
+	log.Printf("loaded %d documents in %v, listening on %s", stats.Documents, stats.Took, c.Addr)
+
+	var admin *http.Server
+	if *pprofAddr != "" {
+		admin = &http.Server{Addr: *pprofAddr, Handler: pprofMux()}
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("pprof: %v", err)
+			}
+		}()
+		log.Printf("pprof on http://%s/debug/pprof/", *pprofAddr)
+	}
+	profiling, stopProfiling := context.WithCancel(context.Background())
+	defer stopProfiling()
+	if *traceDir != "" {
+		go captureProfiles(profiling, *traceDir, *traceEvery, *traceCPU)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		stopProfiling()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if admin != nil {
+			admin.Shutdown(ctx)
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	if c.TLS.Cert != "" {
+		err = server.ListenAndServeTLS(c.TLS.Cert, c.TLS.Key)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jamra/gocleo"
+	"os"
+)
+
+//runVerify checks snapshot files, failing if any is unreadable or
+//would return wrong results.
+func runVerify(args []string) error {
+	fs := newFlagSet("verify")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cleo verify index.cleo ...")
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("verify: no snapshot given")
+	}
+
+	bad := 0
+	for _, path := range fs.Args() {
+		if !verifyFile(path) {
+			bad++
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("verify: %d of %d snapshots are corrupt", bad, fs.NArg())
+	}
+	return nil
+}
+
+func verifyFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return false
+	}
+	defer file.Close()
+
+	report, err := cleo.VerifySnapshot(file)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return false
+	}
+	fmt.Printf("%s: %d documents, %d prefixes, scorer %s", path, report.Documents, report.Prefixes, report.Scorer)
+	if report.Stale > 0 {
+		fmt.Printf(", %d stale entries (run compact)", report.Stale)
+	}
+	if report.Version < cleo.CurrentSnapshotVersion {
+		fmt.Printf(", format version %d (run cleo migrate)", report.Version)
+	}
+	fmt.Println()
+	for _, p := range report.Problems {
+		fmt.Printf("%s: %s\n", path, p)
+	}
+	return len(report.Problems) == 0
+}
@@ -0,0 +1,61 @@
+package cleo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//cacheMaxAge is how long, in seconds, clients and proxies may reuse a
+//search or suggestion response without revalidating it.
+const cacheMaxAge = 60
+
+//etagNonce tells this process's ETags from those of earlier runs and
+//other replicas, whose index generations count from 1 as well.
+var etagNonce = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+//responseETag identifies a search response.  Results only change with
+//the index, so it covers the index generation, the request, and the
+//headers that pick a representation.
+func responseETag(r *http.Request, m *indexContainer) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00%s\x00%s\x00%s",
+		etagNonce, m.generation, r.URL.Path, r.URL.RawQuery, r.Header.Get("Accept"), r.Header.Get("Accept-Encoding"))
+	return `"` + strconv.FormatUint(h.Sum64(), 36) + `"`
+}
+
+//notModified answers 304 if the client already has the response with
+//the given ETag.  It is called once the request has been validated.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			cacheHeaders(w, etag)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+//cacheHeaders marks a successful response as cacheable.  Responses to
+//authenticated requests may only be kept by the client itself.
+func cacheHeaders(w http.ResponseWriter, etag string) {
+	header := w.Header()
+	header.Set("ETag", etag)
+	if ValidateToken != nil {
+		header.Set("Cache-Control", "private, max-age="+strconv.Itoa(cacheMaxAge))
+		header.Add("Vary", "Authorization, X-Api-Key")
+	} else {
+		header.Set("Cache-Control", "public, max-age="+strconv.Itoa(cacheMaxAge))
+	}
+	header.Add("Vary", "Accept")
+}
@@ -1,14 +1,46 @@
 package main
 
 import (
+	"context"
+	"embed"
 	"github.com/jamra/gocleo"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+//The corpus is compiled into the binary, so it runs from any directory
+//
+//go:embed w1_fixed.txt
+var corpus embed.FS
+
 func main() {
-	cleo.BuildIndexes("./w1_fixed.txt", nil)
-	err := http.ListenAndServe(":9999", nil)
-	if err != nil {
+	if _, err := cleo.LoadFromFS(corpus, "w1_fixed.txt", nil); err != nil {
+		log.Fatal(err)
+	}
+
+	server := cleo.NewServer(":9999", cleo.DefaultServerOptions)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+
+		//Let in-flight searches finish before exiting
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
 		panic(err)
 	}
+	<-done
 }
@@ -0,0 +1,92 @@
+package cleo
+
+import (
+	"net/http"
+	"strings"
+)
+
+//An Explanation breaks down how a search for Query treats Candidate,
+//step by step, for debugging relevance.
+type Explanation struct {
+	Query      string   `json:"query"`
+	Rewritten  string   `json:"rewritten"` //after QueryRewriters and removing negated terms
+	Excluded   []string `json:"excluded,omitempty"`
+	Prefix     string   `json:"prefix"`
+	Candidate  string   `json:"candidate"`
+	InBucket   bool     `json:"in_bucket"`  //candidate is in the query's prefix bucket
+	BloomPass  bool     `json:"bloom_pass"` //candidate's bloom filter covers the query's
+	ExcludedBy string   `json:"excluded_by,omitempty"`
+	Distance   int      `json:"distance"`
+	Score      float64  `json:"score"`
+	Scorer     string   `json:"scorer"`
+	Returned   bool     `json:"returned"` //CleoSearch would return the candidate
+}
+
+//Explain reports how CleoSearch would treat candidate when searching
+//for query.  A query left empty by rewriting and negation matches
+//nothing, so its Distance and Score are left zero.
+func Explain(iIndex CandidateSource, fIndex DocumentSource, query, candidate string) Explanation {
+	return explain(iIndex, fIndex, query, candidate, chosenScoringFunction())
+}
+
+func explain(iIndex CandidateSource, fIndex DocumentSource, query, candidate string, score fn_score) Explanation {
+	e := Explanation{Query: query, Candidate: candidate, Scorer: scorerName(score)}
+	e.Rewritten, e.Excluded = parseQuery(rewriteQuery(query))
+	e.Prefix = getPrefix(e.Rewritten)
+
+	qBloom := computeBloomFilter(e.Rewritten)
+	bloom := computeBloomFilter(candidate)
+	for _, doc := range iIndex.PrefixCandidates(e.Rewritten) {
+		if fIndex.Lookup(doc.docId) == candidate {
+			e.InBucket = true
+			bloom = doc.bloom
+			break
+		}
+	}
+	e.BloomPass = TestBytesFromQuery(bloom, qBloom)
+
+	c := strings.ToLower(candidate)
+	for _, ex := range e.Excluded {
+		if strings.HasPrefix(c, ex) {
+			e.ExcludedBy = ex
+			break
+		}
+	}
+
+	if strings.TrimSpace(e.Rewritten) != "" {
+		e.Distance = LevenshteinDistance(e.Rewritten, candidate)
+		e.Score = score(e.Rewritten, candidate)
+	}
+	e.Returned = e.InBucket && e.BloomPass && e.ExcludedBy == ""
+	return e
+}
+
+//explainHandler serves Explain for the query and candidate
+//parameters against the served index.
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	query, candidate := r.FormValue("query"), r.FormValue("candidate")
+	if candidate == "" {
+		writeError(w, http.StatusBadRequest, "candidate is required")
+		return
+	}
+	if err := checkQuery(query); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if rewritten, _ := parseQuery(rewriteQuery(query)); strings.TrimSpace(rewritten) == "" {
+		writeError(w, http.StatusBadRequest, "query has no terms to search for")
+		return
+	}
+	score, err := requestScorer(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	m := requestIndex(r)
+	if m == nil {
+		writeError(w, http.StatusServiceUnavailable, "index not built")
+		return
+	}
+	writeJSON(w, explain(m, m, query, candidate, score))
+}
@@ -0,0 +1,229 @@
+package cleo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A Fetcher reads the object a URL names, such as a corpus or a
+//snapshot kept in object storage.
+type Fetcher interface {
+	Fetch(ctx context.Context, u *url.URL) (io.ReadCloser, error)
+}
+
+//FetcherFunc lets an ordinary function be used as a Fetcher.
+type FetcherFunc func(ctx context.Context, u *url.URL) (io.ReadCloser, error)
+
+func (f FetcherFunc) Fetch(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	return f(ctx, u)
+}
+
+//fetchers holds the Fetcher of each URL scheme.  s3 and gs URLs are
+//fetched from the public HTTPS endpoints of their buckets, so private
+//buckets need a Fetcher using the provider's SDK registered in their
+//place.
+var fetchers = map[string]Fetcher{
+	"http":  FetcherFunc(fetchHTTP),
+	"https": FetcherFunc(fetchHTTP),
+	"s3": FetcherFunc(func(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+		return fetchHTTP(ctx, &url.URL{Scheme: "https", Host: u.Host + ".s3.amazonaws.com", Path: u.Path})
+	}),
+	"gs": FetcherFunc(func(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+		return fetchHTTP(ctx, &url.URL{Scheme: "https", Host: "storage.googleapis.com", Path: "/" + u.Host + u.Path})
+	}),
+}
+
+//FetchTimeout bounds how long fetching a URL may take, reading it
+//included, so a server that stops answering cannot hang loading,
+//reloading or refetching.  Zero means no limit.
+var FetchTimeout = 10 * time.Minute
+
+//RegisterFetcher makes f fetch the URLs with the given scheme,
+//replacing any Fetcher registered for it.  It is not safe to call
+//while loading, so register fetchers at startup.
+func RegisterFetcher(scheme string, f Fetcher) {
+	fetchers[strings.ToLower(scheme)] = f
+}
+
+func fetchHTTP(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cleo: fetching %s: %s", u.Redacted(), resp.Status)
+	}
+	return resp.Body, nil
+}
+
+//Open opens location, which is either a file name or a URL with a
+//scheme that has a Fetcher.
+func Open(ctx context.Context, location string) (io.ReadCloser, error) {
+	if !strings.Contains(location, "://") {
+		return os.Open(location)
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "file" {
+		return os.Open(u.Path)
+	}
+	f, ok := fetchers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("cleo: no fetcher for %s URLs", u.Scheme)
+	}
+	if FetchTimeout <= 0 {
+		return f.Fetch(ctx, u)
+	}
+	ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+	rc, err := f.Fetch(ctx, u)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return cancelOnClose{rc, cancel}, nil
+}
+
+//cancelOnClose ends a fetch's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+//fetched remembers the checksum of what LoadFrom last read from each
+//location, so refetching can skip unchanged objects.
+var fetched = struct {
+	sync.Mutex
+	sums map[string]uint32
+}{sums: make(map[string]uint32)}
+
+//LoadFrom reads a snapshot or a corpus from a file or URL and starts
+//serving it.  Snapshots, recognized by their header, keep the scorer
+//they were saved with; a corpus is indexed with score, or Score if it
+//is nil.  An index loaded from a corpus URL is rebuilt from that URL by
+//ReloadIndexes.
+func LoadFrom(ctx context.Context, location string, score fn_score) (BuildStats, error) {
+	_, stats, err := load(ctx, location, score, false)
+	return stats, err
+}
+
+//RefetchEvery reads location again every interval until ctx is done,
+//serving what it holds whenever that has changed since it was last
+//loaded.  Failures are logged and the current index is kept.
+func RefetchEvery(ctx context.Context, location string, interval time.Duration, score fn_score) {
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+			changed, stats, err := load(ctx, location, score, true)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("cleo: refetching %s: %v", location, err)
+			} else if changed {
+				log.Printf("cleo: reloaded %d documents from %s", stats.Documents, location)
+			}
+		}
+	}()
+}
+
+//load reads location whole, so a connection dropped midway is an error
+//rather than a truncated index.  With onlyChanged it does nothing when
+//the contents match those loaded last.
+func load(ctx context.Context, location string, score fn_score, onlyChanged bool) (bool, BuildStats, error) {
+	rc, err := Open(ctx, location)
+	if err != nil {
+		return false, BuildStats{}, err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return false, BuildStats{}, err
+	}
+
+	sum := crc32.ChecksumIEEE(data)
+	fetched.Lock()
+	last, seen := fetched.sums[location]
+	fetched.Unlock()
+	if onlyChanged && seen && last == sum {
+		return false, BuildStats{}, nil
+	}
+
+	stats, err := loadData(location, data, score)
+	if err != nil {
+		return false, BuildStats{}, err
+	}
+	fetched.Lock()
+	fetched.sums[location] = sum
+	fetched.Unlock()
+	return true, stats, nil
+}
+
+//LoadFromFS reads a snapshot or a corpus from path in fsys and starts
+//serving it, as LoadFrom does.  It lets a binary carry its dictionary
+//embedded with go:embed.  A corpus read this way cannot be reread by
+//ReloadIndexes.
+func LoadFromFS(fsys fs.FS, path string, score fn_score) (BuildStats, error) {
+	data, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return BuildStats{}, err
+	}
+	return loadData("", data, score)
+}
+
+//loadData serves data, a snapshot or else a corpus read from location.
+func loadData(location string, data []byte, score fn_score) (BuildStats, error) {
+	if bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		return LoadIndexes(bytes.NewReader(data))
+	}
+	return indexCorpus(location, bytes.NewReader(data), score)
+}
+
+//indexCorpus indexes corpus and starts serving it as read from
+//location.
+func indexCorpus(location string, corpus io.Reader, score fn_score) (BuildStats, error) {
+	if score == nil {
+		score = Score
+	}
+	start := time.Now()
+	m := &indexContainer{iIndex: NewInvertedIndex(), fIndex: NewForwardIndex(), score: score, corpusPath: location}
+	readCorpus(m.iIndex, m.fIndex, corpus)
+	if len(*m.fIndex) == 0 {
+		return BuildStats{}, errors.New("cleo: corpus holds no documents")
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	publish(m)
+	if err := checkpointJournal(); err != nil {
+		return BuildStats{}, err
+	}
+	return BuildStats{len(*m.fIndex), m.iIndex.Size(), time.Since(start)}, nil
+}
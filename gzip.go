@@ -0,0 +1,90 @@
+package cleo
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+//GzipMinSize is the smallest response, in bytes, that gzipHandler will
+//compress.  Smaller responses gain little and are sent as is.
+var GzipMinSize = 1024
+
+//gzipHandler compresses the responses of h for clients that accept
+//gzip, once they grow past GzipMinSize.
+func gzipHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		h(gw, r)
+	}
+}
+
+//gzipResponseWriter buffers the response until it reaches GzipMinSize
+//and only then commits to compressing it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	g.status = status
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= GzipMinSize {
+		if err := g.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+//Flush commits to compression, since a streamed response's final size
+//is not known up front.
+func (g *gzipResponseWriter) Flush() {
+	if g.gz == nil && g.start() != nil {
+		return
+	}
+	g.gz.Flush()
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) start() error {
+	h := g.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+func (g *gzipResponseWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+		return
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	g.ResponseWriter.Write(g.buf)
+}
@@ -0,0 +1,144 @@
+package cleo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//defaultIndexName is how the index built by BuildIndexes is named in
+//the indexes routes.
+const defaultIndexName = "default"
+
+//named holds the indexes built by BuildNamedIndex.  Each one is
+//replaced whole on rebuild, like the default index.
+var (
+	namedMu sync.RWMutex
+	named   = make(map[string]*indexContainer)
+)
+
+//BuildNamedIndex reads a corpus into an index served alongside the
+//default one, under /cleo/v1/indexes/{name}/.  Building a name again
+//replaces its index once the new one is complete.  corpusPath is a
+//file name or a URL, as LoadFrom takes; a URL is read whole before
+//indexing, so a dropped connection is an error.
+func BuildNamedIndex(name, corpusPath string, scoringFunction fn_score) (BuildStats, error) {
+	if err := checkIndexName(name); err != nil {
+		return BuildStats{}, err
+	}
+	start := time.Now()
+
+	rc, err := Open(context.Background(), corpusPath)
+	if err != nil {
+		return BuildStats{}, err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return BuildStats{}, err
+	}
+
+	m := &indexContainer{iIndex: NewInvertedIndex(), fIndex: NewForwardIndex(), score: scoringFunction, corpusPath: corpusPath}
+	if m.score == nil {
+		m.score = Score
+	}
+	readCorpus(m.iIndex, m.fIndex, bytes.NewReader(data))
+	publishNamed(name, m)
+
+	return BuildStats{len(*m.fIndex), m.iIndex.Size(), time.Since(start)}, nil
+}
+
+func checkIndexName(name string) error {
+	if name == "" || name == defaultIndexName || strings.Contains(name, "/") {
+		return fmt.Errorf("cleo: invalid index name %q", name)
+	}
+	return nil
+}
+
+//publishNamed starts serving m under name in place of any index there.
+func publishNamed(name string, m *indexContainer) {
+	m.generation = atomic.AddUint64(&generations, 1)
+	namedMu.Lock()
+	named[name] = m
+	namedMu.Unlock()
+}
+
+//namedIndex returns the index served under name, or nil.
+func namedIndex(name string) *indexContainer {
+	if name == defaultIndexName {
+		return snapshot()
+	}
+	namedMu.RLock()
+	defer namedMu.RUnlock()
+	return named[name]
+}
+
+type indexContextKey struct{}
+
+//requestIndex returns the index a request should search: the one
+//chosen by its /indexes/{name}/ path, or else the default index.
+func requestIndex(r *http.Request) *indexContainer {
+	if m, ok := r.Context().Value(indexContextKey{}).(*indexContainer); ok {
+		return m
+	}
+	return snapshot()
+}
+
+//indexHandlers are the handlers reachable under an index's path.
+var indexHandlers = map[string]http.HandlerFunc{
+	"search":  searchHandler,
+	"batch":   batchHandler,
+	"suggest": suggestHandler,
+	"explain": explainHandler,
+}
+
+//indexesHandler lists the served indexes at /cleo/v1/indexes, and
+//routes /cleo/v1/indexes/{name}/{endpoint} to that index.
+func indexesHandler(w http.ResponseWriter, r *http.Request) {
+	rest := r.URL.Path[strings.Index(r.URL.Path, "/indexes")+len("/indexes"):]
+	rest = strings.Trim(rest, "/")
+	if rest == "" {
+		writeJSON(w, listIndexes())
+		return
+	}
+
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 || indexHandlers[parts[1]] == nil {
+		writeError(w, http.StatusNotFound, "use /indexes/{name}/search, batch, suggest, or explain")
+		return
+	}
+	m := namedIndex(parts[0])
+	if m == nil {
+		writeError(w, http.StatusNotFound, "no index named "+parts[0])
+		return
+	}
+	indexHandlers[parts[1]](w, r.WithContext(context.WithValue(r.Context(), indexContextKey{}, m)))
+}
+
+//IndexInfo describes a served index.
+type IndexInfo struct {
+	Name      string `json:"name"`
+	Documents int    `json:"documents"`
+	Prefixes  int    `json:"prefixes"`
+}
+
+func listIndexes() []IndexInfo {
+	var infos []IndexInfo
+	if m := snapshot(); m != nil {
+		infos = append(infos, IndexInfo{defaultIndexName, m.documents(), m.prefixes()})
+	}
+	namedMu.RLock()
+	for name, m := range named {
+		infos = append(infos, IndexInfo{name, m.documents(), m.prefixes()})
+	}
+	namedMu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
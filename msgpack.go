@@ -0,0 +1,118 @@
+package cleo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//wantsMsgpack reports whether the client's Accept header asks for
+//MessagePack.
+func wantsMsgpack(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/msgpack") || strings.Contains(accept, "application/x-msgpack")
+}
+
+//appendResults encodes results as a MessagePack array of maps shaped
+//like their JSON form: {"Word": ..., "Score": ...}.
+func appendResults(b []byte, rslt []RankedResult) []byte {
+	b = appendArrayHeader(b, len(rslt))
+	for _, r := range rslt {
+		b = append(b, 0x82) //fixmap with 2 entries
+		b = appendString(b, "Word")
+		b = appendString(b, r.Word)
+		b = appendString(b, "Score")
+		b = append(b, 0xcb) //float 64
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(r.Score))
+	}
+	return b
+}
+
+//appendValue encodes a body as built for JSON by ResponseFormat: maps
+//with string keys, slices, results, strings, numbers and booleans.
+//Map keys are written in sorted order.
+func appendValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case int:
+		if v >= 0 && v < 128 {
+			return append(b, byte(v)) //positive fixint
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+	case float64:
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v))
+	case string:
+		return appendString(b, v)
+	case []RankedResult:
+		return appendResults(b, v)
+	case []interface{}:
+		b = appendArrayHeader(b, len(v))
+		for _, item := range v {
+			b = appendValue(b, item)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMapHeader(b, len(keys))
+		for _, k := range keys {
+			b = appendValue(appendString(b, k), v[k])
+		}
+		return b
+	}
+	panic(fmt.Sprintf("cleo: cannot encode %T as MessagePack", v))
+}
+
+func appendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+func appendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+//writeMsgpack writes an already encoded MessagePack body.
+func writeMsgpack(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "application/msgpack")
+	w.Write(body)
+}
@@ -0,0 +1,207 @@
+package cleo
+
+import (
+	"net/http"
+	"strings"
+)
+
+//openapiSchemas describes the JSON bodies named by routes.  The
+//result schemas are added by openapiDocument, from the ResponseFormat
+//being served.
+var openapiSchemas = map[string]interface{}{
+	"ResultSets": arrayOf(ref("Results")),
+	"Queries":    arrayOf(map[string]string{"type": "string"}),
+	"Words":      arrayOf(map[string]string{"type": "string"}),
+	"Counts": map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": map[string]string{"type": "integer"},
+	},
+	"BuildStats": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"documents": map[string]string{"type": "integer"},
+			"prefixes":  map[string]string{"type": "integer"},
+			"took_ns":   map[string]string{"type": "integer"},
+		},
+	},
+	"Suggestion": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"word":      map[string]string{"type": "string"},
+			"score":     map[string]string{"type": "number"},
+			"highlight": arrayOf(arrayOf(map[string]string{"type": "integer"})),
+		},
+	},
+	"Suggestions": arrayOf(ref("Suggestion")),
+	"Explanation": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"query":       map[string]string{"type": "string"},
+			"rewritten":   map[string]string{"type": "string"},
+			"excluded":    arrayOf(map[string]string{"type": "string"}),
+			"prefix":      map[string]string{"type": "string"},
+			"candidate":   map[string]string{"type": "string"},
+			"in_bucket":   map[string]string{"type": "boolean"},
+			"bloom_pass":  map[string]string{"type": "boolean"},
+			"excluded_by": map[string]string{"type": "string"},
+			"distance":    map[string]string{"type": "integer"},
+			"score":       map[string]string{"type": "number"},
+			"scorer":      map[string]string{"type": "string"},
+			"returned":    map[string]string{"type": "boolean"},
+		},
+	},
+	"Stats": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"documents":          map[string]string{"type": "integer"},
+			"prefixes":           map[string]string{"type": "integer"},
+			"queries":            map[string]string{"type": "integer"},
+			"qps":                map[string]string{"type": "number"},
+			"latency_p50_ms":     map[string]string{"type": "number"},
+			"latency_p95_ms":     map[string]string{"type": "number"},
+			"latency_p99_ms":     map[string]string{"type": "number"},
+			"bloom_reject_ratio": map[string]string{"type": "number"},
+		},
+	},
+	"Indexes": arrayOf(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name":      map[string]string{"type": "string"},
+			"documents": map[string]string{"type": "integer"},
+			"prefixes":  map[string]string{"type": "integer"},
+		},
+	}),
+	"Error": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"error": map[string]string{"type": "string"},
+		},
+	},
+}
+
+//openapiHandler serves an OpenAPI 3 document generated from routes.
+func openapiHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, openapiDocument())
+}
+
+func openapiDocument() map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	add := func(path, method string, op map[string]interface{}) {
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(method)] = op
+	}
+	for _, rt := range routes {
+		path := rt.path
+		if path == "" {
+			path = rt.pattern
+		}
+		add(path, rt.method, operation(rt))
+		if rt.legacy != "" {
+			op := operation(rt)
+			op["deprecated"] = true
+			add(rt.legacy+strings.TrimPrefix(path, rt.pattern), rt.method, op)
+		}
+	}
+
+	schemas := make(map[string]interface{}, len(openapiSchemas)+3)
+	for name, schema := range openapiSchemas {
+		schemas[name] = schema
+	}
+	result, results, streamHeader := serverOptions.Response.schemas()
+	schemas["Result"], schemas["Results"] = result, results
+	if streamHeader != nil {
+		schemas["StreamHeader"] = streamHeader
+	}
+	components := map[string]interface{}{"schemas": schemas}
+	doc := map[string]interface{}{
+		"openapi":    "3.0.3",
+		"info":       map[string]string{"title": "cleo", "version": apiVersion},
+		"paths":      paths,
+		"components": components,
+	}
+	if ValidateToken != nil {
+		components["securitySchemes"] = map[string]interface{}{
+			"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+		}
+		doc["security"] = []map[string][]string{{"bearer": {}}, {"apiKey": {}}}
+	}
+	return doc
+}
+
+func operation(rt route) map[string]interface{} {
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     jsonContent(ref("Error")),
+	}
+	op := map[string]interface{}{
+		"summary": rt.summary,
+		"responses": map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "OK",
+				"content":     resultContent(rt),
+			},
+			"default": errorResponse,
+		},
+	}
+	if rt.admin {
+		op["tags"] = []string{"admin"}
+	}
+
+	var params []map[string]interface{}
+	for _, p := range rt.params {
+		params = append(params, map[string]interface{}{
+			"name":        p.name,
+			"in":          p.in,
+			"required":    p.in == "path",
+			"description": p.description,
+			"schema":      map[string]string{"type": p.typ},
+		})
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if rt.body != "" {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(ref(rt.body)),
+		}
+	}
+	return op
+}
+
+func ref(schema string) map[string]string {
+	return map[string]string{"$ref": "#/components/schemas/" + schema}
+}
+
+func arrayOf(items interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+//resultContent lists the representations of a route's result.  Search
+//results can also be had as MessagePack and, with stream=1, NDJSON.
+func resultContent(rt route) map[string]interface{} {
+	content := jsonContent(ref(rt.result))
+	if rt.result != "Results" && rt.result != "ResultSets" {
+		return content
+	}
+	content["application/msgpack"] = map[string]interface{}{"schema": ref(rt.result)}
+	for _, p := range rt.params {
+		if p == streamParam {
+			line := interface{}(ref("Result"))
+			if serverOptions.Response.Envelope {
+				line = map[string]interface{}{"oneOf": []interface{}{ref("StreamHeader"), ref("Result")}}
+			}
+			content["application/x-ndjson"] = map[string]interface{}{"schema": line}
+		}
+	}
+	return content
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
@@ -0,0 +1,125 @@
+package cleo
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//A RateLimiter gives each client a token bucket that refills at rps
+//tokens a second and holds at most burst.  Clients are told apart by
+//an API key ValidateToken accepted, or else by remote IP.
+type RateLimiter struct {
+	rps   float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element //of *bucket
+	recent  *list.List               //buckets, most recently used first
+}
+
+type bucket struct {
+	client string
+	tokens float64
+	last   time.Time
+}
+
+//maxBuckets bounds the clients tracked.  Past it the least recently
+//seen client is forgotten, which at worst gives it a full bucket.
+const maxBuckets = 10000
+
+//NewRateLimiter returns a RateLimiter refilling rps tokens a second
+//into buckets of burst tokens.  Both must be positive.
+func NewRateLimiter(rps float64, burst int) (*RateLimiter, error) {
+	if !(rps > 0) || math.IsInf(rps, 1) || burst < 1 {
+		return nil, fmt.Errorf("cleo: rate limit needs a positive rate and burst, got %v and %d", rps, burst)
+	}
+	return &RateLimiter{
+		rps:     rps,
+		burst:   float64(burst),
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+	}, nil
+}
+
+//RateLimit, when set, limits how often each client may call the cleo
+//endpoints.  Limited requests get a 429 with Retry-After.  Requests
+//failing authentication are limited too, by remote IP, so tokens
+//cannot be guessed at full speed.
+var RateLimit *RateLimiter
+
+//allow takes a token from the client's bucket.  If the bucket is empty
+//it returns false and how long until the next token.
+func (l *RateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if e, ok := l.buckets[client]; ok {
+		l.recent.MoveToFront(e)
+		b = e.Value.(*bucket)
+	} else {
+		if len(l.buckets) >= maxBuckets {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).client)
+		}
+		b = &bucket{client: client, tokens: l.burst, last: now}
+		l.buckets[client] = l.recent.PushFront(b)
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rps)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rps * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+//rateLimit rejects requests from clients that are over RateLimit.
+func rateLimit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limited(w, clientKey(r)) {
+			h(w, r)
+		}
+	}
+}
+
+//limited takes a token from client's bucket in RateLimit, replying
+//with a 429 and returning true when there is none.
+func limited(w http.ResponseWriter, client string) bool {
+	l := RateLimit
+	if l == nil {
+		return false
+	}
+	ok, wait := l.allow(client, time.Now())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+	}
+	return !ok
+}
+
+//clientKey identifies the client by its API key, falling back to the
+//remote IP.  Only keys ValidateToken accepts count, so a client cannot
+//make up keys to get fresh buckets.
+func clientKey(r *http.Request) string {
+	if token := requestToken(r); token != "" && ValidateToken != nil && ValidateToken(token) {
+		return "key:" + token
+	}
+	return "ip:" + remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,109 @@
+package cleo
+
+import "time"
+
+//ResponseFormat shapes the bodies of the search endpoints, for
+//frontends that expect another suggestion service's format.  By
+//default results are sent as a bare array of {"Word", "Score"}
+//objects.  Empty field names fall back to the defaults.  The format
+//applies alike to JSON, MessagePack and NDJSON responses, and to the
+//OpenAPI document.
+type ResponseFormat struct {
+	//Envelope wraps the results in an object that also echoes the
+	//query and reports the total count, time taken, and whether
+	//paging cut results off.  NDJSON streams send those fields as a
+	//first line of their own.
+	Envelope bool
+
+	Results   string //default "results"
+	Query     string //default "query"
+	Total     string //default "total"
+	TookMs    string //default "took_ms"
+	Truncated string //default "truncated"
+
+	Word  string //default "Word"
+	Score string //default "Score"
+}
+
+func fieldName(name, def string) string {
+	if name == "" {
+		return def
+	}
+	return name
+}
+
+//renamed reports whether results need other field names than
+//RankedResult's own.
+func (f ResponseFormat) renamed() bool {
+	return fieldName(f.Word, "Word") != "Word" || fieldName(f.Score, "Score") != "Score"
+}
+
+//result returns r ready to marshal with the configured field names.
+func (f ResponseFormat) result(r RankedResult) interface{} {
+	if !f.renamed() {
+		return r
+	}
+	return map[string]interface{}{fieldName(f.Word, "Word"): r.Word, fieldName(f.Score, "Score"): r.Score}
+}
+
+//results returns rslt ready to marshal with the configured field
+//names.
+func (f ResponseFormat) results(rslt []RankedResult) interface{} {
+	if !f.renamed() {
+		return rslt
+	}
+	out := make([]interface{}, len(rslt))
+	for i, r := range rslt {
+		out[i] = f.result(r)
+	}
+	return out
+}
+
+//header returns the envelope's fields other than the results.
+func (f ResponseFormat) header(query string, total int, took time.Duration, truncated bool) map[string]interface{} {
+	return map[string]interface{}{
+		fieldName(f.Query, "query"):         query,
+		fieldName(f.Total, "total"):         total,
+		fieldName(f.TookMs, "took_ms"):      float64(took) / float64(time.Millisecond),
+		fieldName(f.Truncated, "truncated"): truncated,
+	}
+}
+
+//body returns the response body for one page of a search's results.
+func (f ResponseFormat) body(query string, rslt []RankedResult, total int, took time.Duration, truncated bool) interface{} {
+	if !f.Envelope {
+		return f.results(rslt)
+	}
+	body := f.header(query, total, took, truncated)
+	body[fieldName(f.Results, "results")] = f.results(rslt)
+	return body
+}
+
+//schemas returns the OpenAPI schemas of a result, of a page of them as
+//body shapes it, and of the first line of an NDJSON stream.
+func (f ResponseFormat) schemas() (result, results, streamHeader interface{}) {
+	result = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			fieldName(f.Word, "Word"):   map[string]string{"type": "string"},
+			fieldName(f.Score, "Score"): map[string]string{"type": "number"},
+		},
+	}
+	results = arrayOf(ref("Result"))
+	if !f.Envelope {
+		return result, results, nil
+	}
+	properties := map[string]interface{}{
+		fieldName(f.Query, "query"):         map[string]string{"type": "string"},
+		fieldName(f.Total, "total"):         map[string]string{"type": "integer"},
+		fieldName(f.TookMs, "took_ms"):      map[string]string{"type": "number"},
+		fieldName(f.Truncated, "truncated"): map[string]string{"type": "boolean"},
+	}
+	streamHeader = map[string]interface{}{"type": "object", "properties": properties}
+	withResults := make(map[string]interface{}, len(properties)+1)
+	for name, schema := range properties {
+		withResults[name] = schema
+	}
+	withResults[fieldName(f.Results, "results")] = results
+	return result, map[string]interface{}{"type": "object", "properties": withResults}, streamHeader
+}
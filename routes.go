@@ -0,0 +1,162 @@
+package cleo
+
+import "net/http"
+
+//A route is one endpoint registered by cleo, together with what the
+//OpenAPI document says about it.
+type route struct {
+	pattern string //ServeMux pattern
+	path    string //OpenAPI path, if different from pattern
+	legacy  string //unversioned alias of pattern
+	method  string
+	summary string
+	params  []param
+	body    string //schema of the JSON request body, if any
+	result  string //schema of the JSON response
+	admin   bool
+	handler http.HandlerFunc
+}
+
+type param struct {
+	name, in, typ, description string
+}
+
+var (
+	queryParam  = param{"query", "query", "string", "The text to search for; terms starting with '-' are excluded"}
+	limitParam  = param{"limit", "query", "integer", "Maximum number of results"}
+	offsetParam = param{"offset", "query", "integer", "Number of results to skip"}
+	streamParam = param{"stream", "query", "integer", "1 to stream results as newline-delimited JSON"}
+	wordParam   = param{"word", "path", "string", "The word to delete"}
+
+	candidateParam = param{"candidate", "query", "string", "The word whose treatment to explain"}
+	kParam         = param{"k", "query", "integer", "Number of suggestions, 10 by default and at most 100"}
+	nameParam      = param{"name", "path", "string", "The index to search; the one built by BuildIndexes is named default"}
+	scorerParam    = param{"scorer", "query", "string", "Scoring function: fuzzy, prefix, exact, or a registered name"}
+)
+
+//routes lists every endpoint cleo serves.  They are registered on
+//http.DefaultServeMux by init, under /cleo/v1/ and under the older
+//unversioned paths.
+var routes = []route{
+	{
+		pattern: "/cleo/v1/search",
+		legacy:  "/cleo",
+		method:  "GET",
+		summary: "Search the index",
+		params:  []param{queryParam, limitParam, offsetParam, streamParam, scorerParam},
+		result:  "Results",
+		handler: requireAuth(rateLimit(gzipHandler(searchHandler))),
+	},
+	{
+		pattern: "/cleo/v1/batch",
+		legacy:  "/cleo/batch",
+		method:  "POST",
+		summary: "Run several searches at once",
+		params:  []param{limitParam, offsetParam, scorerParam},
+		body:    "Queries",
+		result:  "ResultSets",
+		handler: requireAuth(rateLimit(gzipHandler(batchHandler))),
+	},
+	{
+		pattern: "/cleo/v1/suggest",
+		legacy:  "/cleo/suggest",
+		method:  "GET",
+		summary: "Typeahead suggestions with highlighted matches",
+		params:  []param{queryParam, kParam, scorerParam},
+		result:  "Suggestions",
+		handler: requireAuth(rateLimit(gzipHandler(suggestHandler))),
+	},
+	{
+		pattern: "/cleo/v1/explain",
+		legacy:  "/cleo/explain",
+		method:  "GET",
+		summary: "Explain how a search treats one candidate",
+		params:  []param{queryParam, candidateParam, scorerParam},
+		result:  "Explanation",
+		handler: requireAuth(rateLimit(explainHandler)),
+	},
+	{
+		pattern: "/cleo/v1/stats",
+		method:  "GET",
+		summary: "Index sizes and recent query latency, QPS, and bloom filter effectiveness",
+		result:  "Stats",
+		handler: requireAuth(rateLimit(statsHandler)),
+	},
+	{
+		pattern: "/cleo/v1/indexes",
+		method:  "GET",
+		summary: "List the served indexes",
+		result:  "Indexes",
+		handler: requireAuth(rateLimit(indexesHandler)),
+	},
+	{
+		pattern: "/cleo/v1/indexes/",
+		path:    "/cleo/v1/indexes/{name}/search",
+		method:  "GET",
+		summary: "Search the named index; batch, suggest, and explain are routed the same way",
+		params:  []param{nameParam, queryParam, limitParam, offsetParam, streamParam, scorerParam},
+		result:  "Results",
+		handler: requireAuth(rateLimit(gzipHandler(indexesHandler))),
+	},
+	{
+		pattern: "/cleo/v1/admin/docs",
+		legacy:  "/cleo/admin/docs",
+		method:  "POST",
+		summary: "Add words to the index",
+		body:    "Words",
+		result:  "Counts",
+		admin:   true,
+		handler: requireAdmin(docsHandler),
+	},
+	{
+		pattern: "/cleo/v1/admin/docs/",
+		path:    "/cleo/v1/admin/docs/{word}",
+		legacy:  "/cleo/admin/docs/",
+		method:  "DELETE",
+		summary: "Delete a word from the index",
+		params:  []param{wordParam},
+		result:  "Counts",
+		admin:   true,
+		handler: requireAdmin(docsHandler),
+	},
+	{
+		pattern: "/cleo/v1/admin/compact",
+		legacy:  "/cleo/admin/compact",
+		method:  "POST",
+		summary: "Drop index entries left behind by deletions",
+		result:  "Counts",
+		admin:   true,
+		handler: requireAdmin(compactHandler),
+	},
+	{
+		pattern: "/cleo/v1/admin/reload",
+		legacy:  "/cleo/admin/reload",
+		method:  "POST",
+		summary: "Rebuild the index from its corpus file, or from a corpus in the body",
+		result:  "BuildStats",
+		admin:   true,
+		handler: requireAdmin(reloadHandler),
+	},
+}
+
+//apiVersion is sent with every response as the Cleo-Api-Version
+//header.  It changes whenever a response changes shape.
+const apiVersion = "1"
+
+func init() {
+	for _, rt := range routes {
+		h := accessLog(versioned(cors(rt.handler)))
+		http.HandleFunc(rt.pattern, h)
+		if rt.legacy != "" {
+			http.HandleFunc(rt.legacy, h)
+		}
+	}
+	http.HandleFunc("/cleo/openapi.json", versioned(openapiHandler))
+}
+
+func versioned(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cleo-Api-Version", apiVersion)
+		h(w, r)
+	}
+}
@@ -0,0 +1,90 @@
+package cleo
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+//scorers maps the names accepted by the scorer parameter to scoring
+//functions.
+var scorers = map[string]fn_score{
+	"fuzzy":  Score,
+	"prefix": PrefixScore,
+	"exact":  ExactScore,
+}
+
+//RegisterScorer makes a scoring function selectable by name with the
+//scorer parameter of the search endpoints.  It is not safe to call
+//while serving.
+func RegisterScorer(name string, score func(query, candidate string) float64) {
+	scorers[name] = score
+}
+
+//PrefixScore scores candidates that start with the query by how much
+//of the candidate the query covers, so shorter completions rank first.
+//Other candidates score 0.
+func PrefixScore(query, candidate string) float64 {
+	if len(candidate) == 0 || !strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(query)) {
+		return 0
+	}
+	return float64(len(query)) / float64(len(candidate))
+}
+
+//ExactScore is 1 for a candidate equal to the query, ignoring case,
+//and 0 otherwise.
+func ExactScore(query, candidate string) float64 {
+	if strings.EqualFold(query, candidate) {
+		return 1
+	}
+	return 0
+}
+
+//requestScorer returns the scorer named by the request's scorer
+//parameter, or the requested index's scorer if there is none.
+func requestScorer(r *http.Request) (fn_score, error) {
+	name := r.FormValue("scorer")
+	if name == "" {
+		if m := requestIndex(r); m != nil {
+			return m.score, nil
+		}
+		return Score, nil
+	}
+	return LookupScorer(name)
+}
+
+//LookupScorer returns the scoring function registered under name.
+func LookupScorer(name string) (fn_score, error) {
+	if score, ok := scorers[name]; ok {
+		return score, nil
+	}
+	return nil, fmt.Errorf("unknown scorer %q, want one of %s", name, strings.Join(ScorerNames(), ", "))
+}
+
+//ScorerNames returns the names of the registered scorers, sorted.
+func ScorerNames() []string {
+	names := make([]string, 0, len(scorers))
+	for n := range scorers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//scorerName returns the registered name of score, or else its
+//function name.
+func scorerName(score fn_score) string {
+	pc := reflect.ValueOf(score).Pointer()
+	for name, s := range scorers {
+		if reflect.ValueOf(s).Pointer() == pc {
+			return name
+		}
+	}
+	if f := runtime.FuncForPC(pc); f != nil {
+		return f.Name()
+	}
+	return "unknown"
+}
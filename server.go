@@ -0,0 +1,69 @@
+package cleo
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//ServerOptions tunes the http.Server made by NewServer and the limits
+//the cleo handlers enforce.  A zero value means no limit.
+type ServerOptions struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	HandlerTimeout time.Duration //time allowed for ranking one search
+	MaxBodyBytes   int64         //largest request body, except corpus uploads to reload
+	MaxQueryLength int           //longest query, in bytes
+	MaxLimit       int           //largest limit parameter; larger ones are clamped
+	MaxBatch       int           //most queries in one batch request
+
+	AllowOrigins []string //origins browsers may call from, "*" for any
+
+	Response ResponseFormat
+}
+
+//DefaultServerOptions are the limits in force until NewServer is
+//called with others.
+var DefaultServerOptions = ServerOptions{
+	ReadTimeout:  10 * time.Second,
+	WriteTimeout: 30 * time.Second,
+	IdleTimeout:  2 * time.Minute,
+
+	MaxBodyBytes:   1 << 20,
+	MaxQueryLength: 256,
+	MaxLimit:       1000,
+	MaxBatch:       100,
+}
+
+//serverOptions holds the handler limits.  It is read without locking.
+var serverOptions = DefaultServerOptions
+
+//NewServer returns an http.Server for addr serving the cleo endpoints
+//on http.DefaultServeMux, and makes the cleo handlers enforce the
+//limits in opts.  Call it before serving.
+func NewServer(addr string, opts ServerOptions) *http.Server {
+	serverOptions = opts
+	return &http.Server{
+		Addr:         addr,
+		ReadTimeout:  opts.ReadTimeout,
+		WriteTimeout: opts.WriteTimeout,
+		IdleTimeout:  opts.IdleTimeout,
+	}
+}
+
+//checkQuery rejects queries over MaxQueryLength.
+func checkQuery(query string) error {
+	if max := serverOptions.MaxQueryLength; max > 0 && len(query) > max {
+		return fmt.Errorf("query longer than %d bytes", max)
+	}
+	return nil
+}
+
+//limitBody caps the request body at MaxBodyBytes.
+func limitBody(w http.ResponseWriter, r *http.Request) {
+	if max := serverOptions.MaxBodyBytes; max > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+}
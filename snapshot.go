@@ -0,0 +1,436 @@
+package cleo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+)
+
+//A snapshot file starts with snapshotMagic, a format version and a
+//count of sections.  Each section is a tag, the length of its payload,
+//the payload, and a big-endian CRC-32 of the payload.  Integers are
+//varints and strings are length prefixed.  Readers skip sections with
+//tags they do not know.
+const (
+	snapshotMagic   = "CLEO"
+	snapshotVersion = 1
+)
+
+//CurrentSnapshotVersion is the format version SaveIndexes and
+//MigrateSnapshot write.
+const CurrentSnapshotVersion = snapshotVersion
+
+//The sections of a snapshot.  Bloom filters are stored with their
+//documents in the inverted index.
+const (
+	sectionConfig   = "config"   //settings the index was built with
+	sectionForward  = "forward"  //document ids and words
+	sectionInverted = "inverted" //prefix buckets of document ids and bloom filters
+)
+
+var (
+	//ErrBadSnapshot is returned by LoadIndexes for input that is not a
+	//snapshot written by SaveIndexes.
+	ErrBadSnapshot = errors.New("cleo: not an index snapshot")
+
+	//ErrSnapshotChecksum is returned by LoadIndexes for a snapshot
+	//whose contents do not match its checksum.
+	ErrSnapshotChecksum = errors.New("cleo: snapshot checksum mismatch")
+)
+
+//SaveIndexes writes the served index to w, so it can be served again
+//with LoadIndexes without rereading the corpus.
+func SaveIndexes(w io.Writer) error {
+	return SaveNamedIndex(defaultIndexName, w)
+}
+
+//LoadIndexes reads a snapshot written by SaveIndexes and starts
+//serving it.  A snapshot saved with a custom scorer can only be loaded
+//once that scorer has been registered under the same name with
+//RegisterScorer.
+func LoadIndexes(r io.Reader) (BuildStats, error) {
+	return LoadNamedIndex(defaultIndexName, r)
+}
+
+//SaveNamedIndex writes the index served under name to w.
+func SaveNamedIndex(name string, w io.Writer) error {
+	m := namedIndex(name)
+	if m == nil {
+		return ErrNoIndex
+	}
+	return writeSnapshot(w, m)
+}
+
+//LoadNamedIndex reads a snapshot and starts serving it under name,
+//replacing any index there.
+func LoadNamedIndex(name string, r io.Reader) (BuildStats, error) {
+	if name != defaultIndexName {
+		if err := checkIndexName(name); err != nil {
+			return BuildStats{}, err
+		}
+	}
+	start := time.Now()
+	m, scorer, _, err := readSnapshot(r)
+	if err != nil {
+		return BuildStats{}, err
+	}
+	score, ok := scorers[scorer]
+	if !ok {
+		return BuildStats{}, fmt.Errorf("cleo: snapshot uses unregistered scorer %q", scorer)
+	}
+	m.score = score
+
+	if name == defaultIndexName {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		publish(m)
+		if err := checkpointJournal(); err != nil {
+			return BuildStats{}, err
+		}
+	} else {
+		publishNamed(name, m)
+	}
+	return BuildStats{len(*m.fIndex), m.iIndex.Size(), time.Since(start)}, nil
+}
+
+//Indexes returns the indexes being served, for use with CleoSearch
+//and the other functions taking them.  They must not be modified.
+func Indexes() (*InvertedIndex, *ForwardIndex) {
+	m := snapshot()
+	if m == nil {
+		return NewInvertedIndex(), NewForwardIndex()
+	}
+	return m.maps()
+}
+
+func writeSnapshot(w io.Writer, m *indexContainer) error {
+	return writeSnapshotScorer(w, m, scorerName(m.score))
+}
+
+//writeSnapshotScorer writes m as using the scorer with the given name.
+func writeSnapshotScorer(w io.Writer, m *indexContainer, scorer string) error {
+	sections := []struct {
+		tag    string
+		encode func(sw *snapshotWriter, m *indexContainer)
+	}{
+		{sectionConfig, func(sw *snapshotWriter, m *indexContainer) { encodeConfig(sw, m, scorer) }},
+		{sectionForward, encodeForward},
+		{sectionInverted, encodeInverted},
+	}
+
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+	sw.w.WriteString(snapshotMagic)
+	sw.uint(snapshotVersion)
+	sw.uint(uint64(len(sections)))
+
+	var payload bytes.Buffer
+	for _, section := range sections {
+		payload.Reset()
+		pw := &snapshotWriter{w: bufio.NewWriter(&payload)}
+		section.encode(pw, m)
+		if pw.err == nil {
+			pw.err = pw.w.Flush()
+		}
+		if pw.err != nil {
+			return pw.err
+		}
+
+		sw.string(section.tag)
+		sw.uint(uint64(payload.Len()))
+		if sw.err == nil {
+			_, sw.err = sw.w.Write(payload.Bytes())
+		}
+		if sw.err == nil {
+			sw.err = binary.Write(sw.w, binary.BigEndian, crc32.ChecksumIEEE(payload.Bytes()))
+		}
+	}
+
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+func encodeConfig(sw *snapshotWriter, m *indexContainer, scorer string) {
+	sw.uint(prefixLength)
+	sw.uint(NUM_BITS)
+	sw.string(scorer)
+	sw.string(m.corpusPath)
+}
+
+func encodeForward(sw *snapshotWriter, m *indexContainer) {
+	_, fIndex := m.maps()
+	//Sorted so the same index always produces the same file
+	ids := make([]int, 0, len(*fIndex))
+	for id := range *fIndex {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	sw.uint(uint64(len(ids)))
+	for _, id := range ids {
+		sw.int(int64(id))
+		sw.string((*fIndex)[id])
+	}
+}
+
+func encodeInverted(sw *snapshotWriter, m *indexContainer) {
+	iIndex, _ := m.maps()
+	prefixes := make([]string, 0, len(*iIndex))
+	for prefix := range *iIndex {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	sw.uint(uint64(len(prefixes)))
+	for _, prefix := range prefixes {
+		docs := (*iIndex)[prefix]
+		sw.string(prefix)
+		sw.uint(uint64(len(docs)))
+		for _, doc := range docs {
+			sw.int(int64(doc.docId))
+			sw.int(int64(doc.bloom))
+		}
+	}
+}
+
+//snapshotReaders read the rest of a snapshot after its version, by
+//version.  Each turns its version into the current in-memory form, so
+//when the format changes older snapshots still load as they are and
+//MigrateSnapshot can rewrite them in the new one.
+var snapshotReaders = map[uint64]func(sr *snapshotReader, m *indexContainer) (string, error){
+	1: readSections,
+}
+
+//readSnapshot reads a snapshot, returning its scorer's name for the
+//caller to resolve and the version it was written in.
+func readSnapshot(r io.Reader) (*indexContainer, string, int, error) {
+	sr := newSnapshotReader(bufio.NewReader(r))
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(sr, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, "", 0, ErrBadSnapshot
+	}
+	version := sr.uint()
+	if sr.err != nil {
+		return nil, "", 0, sr.failed()
+	}
+	read, ok := snapshotReaders[version]
+	if !ok {
+		return nil, "", 0, fmt.Errorf("cleo: unsupported snapshot version %d", version)
+	}
+
+	m := &indexContainer{iIndex: NewInvertedIndex(), fIndex: NewForwardIndex()}
+	scorer, err := read(sr, m)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return m, scorer, int(version), nil
+}
+
+//MigrateSnapshot reads a snapshot of any supported version from r and
+//writes it to w in the current format, returning the version it was
+//written in.  The scorer is kept by name, so it need not be registered.
+func MigrateSnapshot(w io.Writer, r io.Reader) (int, error) {
+	m, scorer, version, err := readSnapshot(r)
+	if err != nil {
+		return 0, err
+	}
+	return version, writeSnapshotScorer(w, m, scorer)
+}
+
+//readSections reads the sections of a version 1 snapshot, checking
+//each one's checksum.
+func readSections(sr *snapshotReader, m *indexContainer) (string, error) {
+	var scorer string
+	found := make(map[string]bool)
+	for n := sr.uint(); n > 0 && sr.err == nil; n-- {
+		tag := sr.string()
+		length := sr.uint()
+		if sr.err != nil {
+			break
+		}
+		if found[tag] {
+			return "", fmt.Errorf("cleo: snapshot section %q appears twice", tag)
+		}
+
+		ps := newSnapshotReader(bufio.NewReader(io.LimitReader(sr.r, int64(length))))
+		switch tag {
+		case sectionConfig:
+			scorer, ps.err = decodeConfig(ps, m)
+		case sectionForward:
+			decodeForward(ps, m)
+		case sectionInverted:
+			decodeInverted(ps, m)
+		}
+		if ps.err == nil {
+			//Skip unknown sections, and config fields added by later versions
+			var rest int64
+			rest, ps.err = io.Copy(io.Discard, ps)
+			if ps.err == nil && rest > 0 && (tag == sectionForward || tag == sectionInverted) {
+				ps.err = fmt.Errorf("cleo: %d unread bytes in snapshot section %q", rest, tag)
+			}
+		}
+		if ps.err != nil {
+			return "", ps.failed()
+		}
+		if ps.read != int64(length) {
+			return "", io.ErrUnexpectedEOF
+		}
+
+		var stored uint32
+		if sr.err = binary.Read(sr.r, binary.BigEndian, &stored); sr.err != nil {
+			break
+		}
+		if stored != ps.crc.Sum32() {
+			return "", ErrSnapshotChecksum
+		}
+		found[tag] = true
+	}
+	if sr.err != nil {
+		return "", sr.failed()
+	}
+	for _, tag := range []string{sectionConfig, sectionForward, sectionInverted} {
+		if !found[tag] {
+			return "", fmt.Errorf("cleo: snapshot has no %q section", tag)
+		}
+	}
+	return scorer, nil
+}
+
+//decodeConfig checks the snapshot was built with the settings of this
+//package and returns its scorer name.  Fields appended by later
+//versions are left for the caller to skip.
+func decodeConfig(sr *snapshotReader, m *indexContainer) (string, error) {
+	prefixLen, bloomBits := sr.uint(), sr.uint()
+	scorer := sr.string()
+	m.corpusPath = sr.string()
+	if sr.err != nil {
+		return "", sr.err
+	}
+	if prefixLen != prefixLength || bloomBits != NUM_BITS {
+		return "", fmt.Errorf("cleo: snapshot built with %d byte prefixes and %d bit bloom filters, want %d and %d",
+			prefixLen, bloomBits, prefixLength, NUM_BITS)
+	}
+	return scorer, nil
+}
+
+func decodeForward(sr *snapshotReader, m *indexContainer) {
+	for n := sr.uint(); n > 0 && sr.err == nil; n-- {
+		id := int(sr.int())
+		(*m.fIndex)[id] = sr.string()
+	}
+}
+
+func decodeInverted(sr *snapshotReader, m *indexContainer) {
+	for n := sr.uint(); n > 0 && sr.err == nil; n-- {
+		prefix := sr.string()
+		count := sr.uint()
+		docs := make([]Document, 0, Min(int(count), 1<<16))
+		for ; count > 0 && sr.err == nil; count-- {
+			docs = append(docs, Document{docId: int(sr.int()), bloom: int(sr.int())})
+		}
+		(*m.iIndex)[prefix] = docs
+	}
+}
+
+//snapshotWriter and snapshotReader keep the first error, so the
+//encoding code can be written without checking every field.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (sw *snapshotWriter) uint(x uint64) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(sw.buf[:binary.PutUvarint(sw.buf[:], x)])
+	}
+}
+
+func (sw *snapshotWriter) int(x int64) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(sw.buf[:binary.PutVarint(sw.buf[:], x)])
+	}
+}
+
+func (sw *snapshotWriter) string(s string) {
+	sw.uint(uint64(len(s)))
+	if sw.err == nil {
+		_, sw.err = sw.w.WriteString(s)
+	}
+}
+
+//The reader hashes the bytes it consumes into crc, and counts them,
+//so checksums can be checked without reading ahead.
+type snapshotReader struct {
+	r    *bufio.Reader
+	crc  hash.Hash32
+	read int64
+	err  error
+}
+
+func newSnapshotReader(r *bufio.Reader) *snapshotReader {
+	return &snapshotReader{r: r, crc: crc32.NewIEEE()}
+}
+
+func (sr *snapshotReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.crc.Write(p[:n])
+	sr.read += int64(n)
+	return n, err
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	c, err := sr.r.ReadByte()
+	if err == nil {
+		sr.crc.Write([]byte{c})
+		sr.read++
+	}
+	return c, err
+}
+
+//failed returns the reader's error, reporting running out of input as
+//a truncated snapshot.
+func (sr *snapshotReader) failed() error {
+	if sr.err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return sr.err
+}
+
+func (sr *snapshotReader) uint() uint64 {
+	if sr.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(sr)
+	sr.err = err
+	return x
+}
+
+func (sr *snapshotReader) int() int64 {
+	if sr.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(sr)
+	sr.err = err
+	return x
+}
+
+func (sr *snapshotReader) string() string {
+	n := sr.uint()
+	if sr.err != nil {
+		return ""
+	}
+	if n > 1<<20 {
+		sr.err = ErrBadSnapshot
+		return ""
+	}
+	b := make([]byte, n)
+	_, sr.err = io.ReadFull(sr, b)
+	return string(b)
+}
@@ -0,0 +1,139 @@
+package cleo
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//latencyWindow is how many recent queries are kept for the latency
+//percentiles and QPS.
+const latencyWindow = 1024
+
+//statsWindow is how far back the latency percentiles and QPS look, so
+//they describe current traffic rather than whatever came before an
+//idle period.
+const statsWindow = time.Minute
+
+//queryStats instruments searches.  Latencies are kept in a ring of
+//the most recent queries; the bloom counters are totals.
+type queryStats struct {
+	queries    uint64
+	candidates uint64
+	rejected   uint64
+
+	mu      sync.Mutex
+	samples [latencyWindow]latencySample
+	next    int
+	filled  bool
+	first   time.Time //of the first query observed
+}
+
+type latencySample struct {
+	at   time.Time
+	took time.Duration
+}
+
+var stats queryStats
+
+func (s *queryStats) observe(start time.Time) {
+	now := time.Now()
+	atomic.AddUint64(&s.queries, 1)
+
+	s.mu.Lock()
+	if s.first.IsZero() {
+		s.first = now
+	}
+	s.samples[s.next] = latencySample{now, now.Sub(start)}
+	s.next = (s.next + 1) % latencyWindow
+	s.filled = s.filled || s.next == 0
+	s.mu.Unlock()
+}
+
+func (s *queryStats) bloomChecked(candidates, rejected int) {
+	atomic.AddUint64(&s.candidates, uint64(candidates))
+	atomic.AddUint64(&s.rejected, uint64(rejected))
+}
+
+//Stats reports the size of the served index and how searches have
+//been performing.  Latencies and QPS cover the queries of the last
+//minute, or the most recent 1024 of them when there were more.
+type Stats struct {
+	Documents        int     `json:"documents"`
+	Prefixes         int     `json:"prefixes"`
+	Queries          uint64  `json:"queries"`
+	QPS              float64 `json:"qps"`
+	LatencyP50Ms     float64 `json:"latency_p50_ms"`
+	LatencyP95Ms     float64 `json:"latency_p95_ms"`
+	LatencyP99Ms     float64 `json:"latency_p99_ms"`
+	BloomRejectRatio float64 `json:"bloom_reject_ratio"` //share of prefix candidates the bloom filter dropped
+}
+
+//CurrentStats returns the current Stats.
+func CurrentStats() Stats {
+	var st Stats
+	if m := snapshot(); m != nil {
+		st.Documents, st.Prefixes = m.documents(), m.prefixes()
+	}
+	st.Queries = atomic.LoadUint64(&stats.queries)
+	if candidates := atomic.LoadUint64(&stats.candidates); candidates > 0 {
+		st.BloomRejectRatio = float64(atomic.LoadUint64(&stats.rejected)) / float64(candidates)
+	}
+
+	var took []time.Duration
+	st.QPS, took = stats.recent(time.Now())
+	if n := len(took); n > 0 {
+		sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+		ms := func(p float64) float64 {
+			return float64(took[int(p*float64(n-1))]) / float64(time.Millisecond)
+		}
+		st.LatencyP50Ms, st.LatencyP95Ms, st.LatencyP99Ms = ms(0.50), ms(0.95), ms(0.99)
+	}
+	return st
+}
+
+//recent returns the QPS and latencies of the queries observed within
+//statsWindow of now.  The rate is taken over the whole window, or the
+//part of it since the first query, or since the oldest sample kept when
+//the ring holds nothing older.
+func (s *queryStats) recent(now time.Time) (float64, []time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.next
+	if s.filled {
+		n = latencyWindow
+	}
+	from := now.Add(-statsWindow)
+	if s.first.After(from) {
+		from = s.first
+	}
+	var took []time.Duration
+	oldest := now
+	for _, sample := range s.samples[:n] {
+		if !sample.at.Before(from) {
+			took = append(took, sample.took)
+			if sample.at.Before(oldest) {
+				oldest = sample.at
+			}
+		}
+	}
+	if len(took) == n && s.filled {
+		from = oldest //queries older than the ring may fall in the window
+	}
+	if span := now.Sub(from).Seconds(); span > 0 && len(took) > 0 {
+		return float64(len(took)) / span, took
+	}
+	return 0, took
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, CurrentStats())
+}
+
+func init() {
+	expvar.Publish("cleo", expvar.Func(func() interface{} { return CurrentStats() }))
+}
@@ -0,0 +1,116 @@
+package cleo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//A Suggestion is a typeahead completion.  Highlight holds the
+//[start, end) byte spans of Word that match the query.
+type Suggestion struct {
+	Word      string   `json:"word"`
+	Score     float64  `json:"score"`
+	Highlight [][2]int `json:"highlight"`
+}
+
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 100
+)
+
+//Suggest returns the k best completions of query, with the part of
+//each that matches the query highlighted.
+func Suggest(iIndex CandidateSource, fIndex DocumentSource, query string, k int) []Suggestion {
+	s, _ := suggest(context.Background(), iIndex, fIndex, query, k, chosenScoringFunction())
+	return s
+}
+
+//SuggestWith is Suggest ranking with score instead of the served
+//index's scorer.
+func SuggestWith(iIndex CandidateSource, fIndex DocumentSource, query string, k int, score fn_score) []Suggestion {
+	s, _ := suggest(context.Background(), iIndex, fIndex, query, k, score)
+	return s
+}
+
+func suggest(ctx context.Context, iIndex CandidateSource, fIndex DocumentSource, query string, k int, score fn_score) ([]Suggestion, error) {
+	rslt, err := search(ctx, iIndex, fIndex, query, score)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(ByScore{rslt})
+	rslt = page(rslt, k, 0)
+
+	q, _ := parseQuery(rewriteQuery(query))
+	suggestions := make([]Suggestion, len(rslt))
+	for i, r := range rslt {
+		suggestions[i] = Suggestion{Word: r.Word, Score: r.Score, Highlight: [][2]int{}}
+		if n := commonPrefixLen(q, r.Word); n > 0 {
+			suggestions[i].Highlight = append(suggestions[i].Highlight, [2]int{0, n})
+		}
+	}
+	return suggestions, nil
+}
+
+//commonPrefixLen returns the length in bytes of the longest prefix of
+//word matching query, ignoring case.  It compares whole runes, so the
+//span never ends inside one.
+func commonPrefixLen(query, word string) int {
+	for i, r := range word {
+		q, size := utf8.DecodeRuneInString(query)
+		if size == 0 || !strings.EqualFold(string(q), string(r)) {
+			return i
+		}
+		query = query[size:]
+	}
+	return len(word)
+}
+
+//suggestHandler serves Suggest for typeahead clients.  k defaults to
+//defaultSuggestions.
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	if err := checkQuery(query); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	k := defaultSuggestions
+	if v := r.FormValue("k"); v != "" {
+		var err error
+		if k, err = strconv.Atoi(v); err != nil || k < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid k %q", v))
+			return
+		}
+		k = Min(k, maxSuggestions)
+	}
+	score, err := requestScorer(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	m := requestIndex(r)
+	if m == nil {
+		writeError(w, http.StatusServiceUnavailable, "index not built")
+		return
+	}
+	etag := responseETag(r, m)
+	if notModified(w, r, etag) {
+		return
+	}
+
+	ctx, cancel := handlerContext(r)
+	defer cancel()
+	suggestions, err := suggest(ctx, m, m, query, k, score)
+	if err != nil {
+		searchFailed(w, err)
+		return
+	}
+	cacheHeaders(w, etag)
+	noteResults(w, len(suggestions), len(suggestions) == k) //a full page may have been cut short
+	writeJSON(w, suggestions)
+}
@@ -0,0 +1,30 @@
+package cleo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+//ClientCertConfig returns a TLS configuration requiring every client
+//to present a certificate signed by one of the CAs in the PEM file
+//caFile.  Set it as the TLSConfig of the http.Server serving /cleo and
+//start it with ListenAndServeTLS to get mutual TLS.
+func ClientCertConfig(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("cleo: no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,332 @@
+package cleo
+
+import (
+	"errors"
+	"strings"
+)
+
+//ErrNoIndex is returned by updates made before BuildIndexes.
+var ErrNoIndex = errors.New("cleo: index not built")
+
+//maxDelta bounds the buckets and documents an index's delta may hold
+//before an update merges it into fresh maps.  Below it each update
+//copies the delta instead of the whole index.
+const maxDelta = 4096
+
+//An indexDelta holds the updates made since an index's maps were last
+//merged.  Like the container it belongs to it is never modified once
+//served.
+type indexDelta struct {
+	buckets   InvertedIndex  //replaced prefix buckets, empty for removed ones
+	words     map[int]string //added documents, "" for deleted ones
+	documents int            //counts of the merged index
+	prefixes  int
+}
+
+func (d *indexDelta) copy() *indexDelta {
+	c := &indexDelta{
+		buckets:   make(InvertedIndex, len(d.buckets)),
+		words:     make(map[int]string, len(d.words)),
+		documents: d.documents,
+		prefixes:  d.prefixes,
+	}
+	for prefix, docs := range d.buckets {
+		c.buckets[prefix] = docs
+	}
+	for docId, word := range d.words {
+		c.words[docId] = word
+	}
+	return c
+}
+
+//update returns a container to apply updates to while m is still
+//being searched.  It shares m's maps and copies only its delta.
+func (m *indexContainer) update() *indexContainer {
+	u := &indexContainer{iIndex: m.iIndex, fIndex: m.fIndex, score: m.score, corpusPath: m.corpusPath, nextId: m.nextDocId()}
+	switch {
+	case m.delta == nil:
+		u.delta = &indexDelta{buckets: make(InvertedIndex), words: make(map[int]string), documents: len(*m.fIndex), prefixes: m.iIndex.Size()}
+	case len(m.delta.buckets)+len(m.delta.words) < maxDelta:
+		u.delta = m.delta.copy()
+	default:
+		u.iIndex, u.fIndex = m.maps()
+		u.delta = &indexDelta{buckets: make(InvertedIndex), words: make(map[int]string), documents: len(*u.fIndex), prefixes: u.iIndex.Size()}
+	}
+	return u
+}
+
+//maps returns the container's whole indexes, merging its delta into
+//copies of its maps the first time they are needed.
+func (m *indexContainer) maps() (*InvertedIndex, *ForwardIndex) {
+	if m.delta == nil {
+		return m.iIndex, m.fIndex
+	}
+	m.merge.Do(func() {
+		iIndex := make(InvertedIndex, m.delta.prefixes)
+		for prefix, docs := range *m.iIndex {
+			iIndex[prefix] = docs
+		}
+		for prefix, docs := range m.delta.buckets {
+			if len(docs) > 0 {
+				iIndex[prefix] = docs
+			} else {
+				delete(iIndex, prefix)
+			}
+		}
+		fIndex := make(ForwardIndex, m.delta.documents)
+		for docId, word := range *m.fIndex {
+			fIndex[docId] = word
+		}
+		for docId, word := range m.delta.words {
+			if word != "" {
+				fIndex[docId] = word
+			} else {
+				delete(fIndex, docId)
+			}
+		}
+		m.merged = &indexContainer{iIndex: &iIndex, fIndex: &fIndex}
+	})
+	return m.merged.iIndex, m.merged.fIndex
+}
+
+//documents and prefixes count the container's documents and buckets.
+func (m *indexContainer) documents() int {
+	if m.delta != nil {
+		return m.delta.documents
+	}
+	return len(*m.fIndex)
+}
+
+func (m *indexContainer) prefixes() int {
+	if m.delta != nil {
+		return m.delta.prefixes
+	}
+	return m.iIndex.Size()
+}
+
+//bucket returns the documents in a prefix bucket.
+func (m *indexContainer) bucket(prefix string) []Document {
+	if m.delta != nil {
+		if docs, ok := m.delta.buckets[prefix]; ok {
+			return docs
+		}
+	}
+	return (*m.iIndex)[prefix]
+}
+
+//PrefixCandidates, PrefixKey and Lookup make a container searchable
+//without merging its delta.
+func (m *indexContainer) PrefixCandidates(query string) []Document {
+	return m.bucket(getPrefix(query))
+}
+
+func (m *indexContainer) PrefixKey(query string) string {
+	return getPrefix(query)
+}
+
+func (m *indexContainer) Lookup(docId int) string {
+	if m.delta != nil {
+		if word, ok := m.delta.words[docId]; ok {
+			return word
+		}
+	}
+	return (*m.fIndex)[docId]
+}
+
+//setBucket and setWord change a container made by update.
+func (m *indexContainer) setBucket(prefix string, docs []Document) {
+	if had := len(m.bucket(prefix)) > 0; had != (len(docs) > 0) {
+		if had {
+			m.delta.prefixes--
+		} else {
+			m.delta.prefixes++
+		}
+	}
+	m.delta.buckets[prefix] = docs
+}
+
+func (m *indexContainer) setWord(docId int, word string) {
+	if had := m.Lookup(docId) != ""; had != (word != "") {
+		if had {
+			m.delta.documents--
+		} else {
+			m.delta.documents++
+		}
+	}
+	m.delta.words[docId] = word
+}
+
+//nextDocId returns one past the largest document id ever used.  Only
+//the first update of a freshly built index has to look for it.
+func (m *indexContainer) nextDocId() int {
+	if m.nextId == 0 {
+		_, fIndex := m.maps()
+		m.nextId = 1
+		for docId := range *fIndex {
+			if docId >= m.nextId {
+				m.nextId = docId + 1
+			}
+		}
+	}
+	return m.nextId
+}
+
+//addWords adds each non-blank word to a container made by update,
+//returning how many were added.  Only the buckets of the words' prefixes
+//are copied.
+func (m *indexContainer) addWords(words []string) int {
+	added := 0
+	for _, word := range words {
+		fields := strings.Fields(word)
+		if len(fields) == 0 {
+			continue
+		}
+		docId := m.nextId
+		m.nextId++
+		bloom := computeBloomFilter(word)
+		for _, prefix := range prefixes(word) {
+			m.setBucket(prefix, append(copyBucket(m.bucket(prefix)), Document{docId: docId, bloom: bloom}))
+		}
+		m.setWord(docId, strings.Join(fields, " ")) //as ForwardIndex.AddDoc keeps it
+		added++
+	}
+	return added
+}
+
+//deleteWord removes every document that is exactly word from a
+//container made by update, returning how many were removed.
+func (m *indexContainer) deleteWord(word string) int {
+	word = strings.Join(strings.Fields(word), " ")
+	if word == "" {
+		return 0
+	}
+
+	deleted := make(map[int]bool)
+	buckets := prefixes(word)
+	for _, doc := range m.bucket(buckets[0]) {
+		if m.Lookup(doc.docId) == word {
+			deleted[doc.docId] = true
+		}
+	}
+	if len(deleted) == 0 {
+		return 0
+	}
+
+	for docId := range deleted {
+		m.setWord(docId, "")
+	}
+	for _, prefix := range buckets {
+		m.setBucket(prefix, removeDocs(m.bucket(prefix), deleted))
+	}
+	return len(deleted)
+}
+
+//compacted returns a copy of m without bucket entries pointing at
+//deleted documents, and without the buckets left empty.
+func (m *indexContainer) compacted() *indexContainer {
+	old, fIndex := m.maps()
+	iIndex := make(InvertedIndex, len(*old))
+	for prefix, docs := range *old {
+		kept := make([]Document, 0, len(docs))
+		for _, doc := range docs {
+			if _, ok := (*fIndex)[doc.docId]; ok {
+				kept = append(kept, doc)
+			}
+		}
+		if len(kept) > 0 {
+			iIndex[prefix] = kept
+		}
+	}
+	return &indexContainer{iIndex: &iIndex, fIndex: fIndex, score: m.score, corpusPath: m.corpusPath, nextId: m.nextId}
+}
+
+//AddWords adds each non-blank word to the served index as a new
+//document, returning how many were added.
+func AddWords(words ...string) (int, error) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	old := snapshot()
+	if old == nil {
+		return 0, ErrNoIndex
+	}
+	m := old.update()
+	n := m.addWords(words)
+
+	if err := logUpdate(walAdd, words...); err != nil {
+		return 0, err
+	}
+	publish(m)
+	return n, nil
+}
+
+//DeleteWord removes every document that is exactly word from the
+//served index, returning how many were removed.
+func DeleteWord(word string) (int, error) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	old := snapshot()
+	if old == nil {
+		return 0, ErrNoIndex
+	}
+	m := old.update()
+	n := m.deleteWord(word)
+	if n == 0 {
+		return 0, nil
+	}
+
+	if err := logUpdate(walDelete, word); err != nil {
+		return 0, err
+	}
+	publish(m)
+	return n, nil
+}
+
+//Compact drops every prefix bucket entry left pointing at a deleted
+//document, and buckets left empty, from the served index.  Such
+//entries come from snapshots and indexes saved by older versions.
+func Compact() error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	old := snapshot()
+	if old == nil {
+		return ErrNoIndex
+	}
+	m := old.compacted()
+
+	if err := logUpdate(walCompact); err != nil {
+		return err
+	}
+	publish(m)
+	return nil
+}
+
+//prefixes returns the prefix buckets AddDoc puts doc in, once each.
+func prefixes(doc string) []string {
+	var p []string
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(doc) {
+		if prefix := getPrefix(word); !seen[prefix] {
+			seen[prefix] = true
+			p = append(p, prefix)
+		}
+	}
+	return p
+}
+
+func copyBucket(docs []Document) []Document {
+	return append([]Document(nil), docs...)
+}
+
+//removeDocs returns a copy of docs without the deleted documents.
+func removeDocs(docs []Document, deleted map[int]bool) []Document {
+	kept := make([]Document, 0, len(docs))
+	for _, doc := range docs {
+		if !deleted[doc.docId] {
+			kept = append(kept, doc)
+		}
+	}
+	return kept
+}
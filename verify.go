@@ -0,0 +1,99 @@
+package cleo
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+//A VerifyReport describes a snapshot checked by VerifySnapshot.
+//Problems lists what makes the index return wrong results; an index is
+//sound when it is empty.
+type VerifyReport struct {
+	Scorer    string
+	Version   int //format version, older than CurrentSnapshotVersion until migrated
+	Documents int
+	Prefixes  int
+	Stale     int //bucket entries of deleted documents, which Compact drops
+	Problems  []string
+}
+
+//maxProblems bounds how many problems a report lists.
+const maxProblems = 100
+
+//VerifySnapshot reads a snapshot written by SaveIndexes without serving
+//it and checks that every document can be found: that it is in the
+//bucket of its prefix, with a bloom filter passing a search for the
+//document itself.  A snapshot that cannot be read, or whose checksum
+//does not match, is an error.
+func VerifySnapshot(r io.Reader) (VerifyReport, error) {
+	m, name, version, err := readSnapshot(r)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	report := m.verify()
+	report.Scorer, report.Version = name, version
+	if _, ok := scorers[name]; !ok {
+		report.Problems = append(report.Problems, fmt.Sprintf("scorer %q is not registered", name))
+	}
+	return report, nil
+}
+
+func (m *indexContainer) verify() VerifyReport {
+	iIndex, fIndex := m.maps()
+	report := VerifyReport{Documents: len(*fIndex), Prefixes: iIndex.Size()}
+	problem := func(format string, args ...interface{}) {
+		if len(report.Problems) < maxProblems {
+			report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	blooms := make(map[string]map[int]int) //prefix to docId to bloom
+	prefixes := make([]string, 0, len(*iIndex))
+	for prefix := range *iIndex {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		if prefix == "" || len(prefix) > prefixLength || prefix != strings.ToLower(prefix) {
+			problem("bucket %q is not a lowercased prefix of at most %d bytes", prefix, prefixLength)
+		}
+		bucket := make(map[int]int)
+		for _, doc := range (*iIndex)[prefix] {
+			if _, ok := (*fIndex)[doc.docId]; !ok {
+				report.Stale++
+				continue
+			}
+			bucket[doc.docId] |= doc.bloom
+		}
+		blooms[prefix] = bucket
+	}
+
+	ids := make([]int, 0, len(*fIndex))
+	for id := range *fIndex {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		word := (*fIndex)[id]
+		fields := strings.Fields(word)
+		if len(fields) == 0 {
+			problem("document %d is empty", id)
+			continue
+		}
+		//Searches find a document by its first word; its other words
+		//only need their buckets
+		for i, field := range fields {
+			prefix := getPrefix(field)
+			bloom, ok := blooms[prefix][id]
+			switch {
+			case !ok:
+				problem("document %d %q is missing from bucket %q", id, word, prefix)
+			case i == 0 && !TestBytesFromQuery(bloom, computeBloomFilter(field)):
+				problem("document %d %q has a bloom filter that rejects the document itself", id, word)
+			}
+		}
+	}
+	return report
+}
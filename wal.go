@@ -0,0 +1,375 @@
+package cleo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//A write-ahead log file starts with walMagic and the CRC-32 of the
+//snapshot file it applies to.  Each record is the length of its
+//payload, the payload, and a CRC-32 of the payload.  A payload is an
+//operation byte, a count of words, and the words.
+const walMagic = "CLEOWAL1"
+
+const (
+	walAdd     = 'A'
+	walDelete  = 'D'
+	walCompact = 'C'
+)
+
+//A WAL keeps AddWords, DeleteWord and Compact durable between
+//snapshots.  Each update is synced to the log before it is served, and
+//the log is replayed on top of the snapshot when it is reopened.
+type WAL struct {
+	snapshotPath string
+	path         string
+
+	mu      sync.Mutex //guards the fields below, besides writeMu
+	file    *os.File
+	size    int64 //length of the log up to its last whole record
+	failed  error //set when a bad append could not be undone
+	records int
+	stop    chan struct{}
+}
+
+//journal is the open WAL, if any.  It is only changed holding writeMu.
+var journal *WAL
+
+//OpenWAL replays the updates logged at walPath onto the served index,
+//then logs every later update there.  The served index must be the one
+//in the snapshot file at snapshotPath, loaded with LoadIndexes, or a
+//fresh one when that file does not exist yet.  A log left from another
+//snapshot, as after a crash during Checkpoint, holds updates the
+//snapshot already has and is discarded.  Call it before serving.
+func OpenWAL(snapshotPath, walPath string) (*WAL, error) {
+	if snapshot() == nil {
+		return nil, ErrNoIndex
+	}
+	if journal != nil {
+		return nil, errors.New("cleo: a WAL is already open")
+	}
+	w := &WAL{snapshotPath: snapshotPath, path: walPath, stop: make(chan struct{})}
+
+	sum, err := fileChecksum(snapshotPath)
+	if err == nil {
+		err = w.replay(sum)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	//Start from a snapshot of everything replayed and an empty log
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	if err := w.checkpoint(); err != nil {
+		return nil, err
+	}
+	journal = w
+	return w, nil
+}
+
+//replay applies the records of a log written for the snapshot with
+//checksum sum to a copy of the served index, then serves it.  A torn
+//record at the very end, from a crash while appending, is ignored; a
+//damaged record with more after it is an error, since skipping it
+//would lose the updates that follow.
+func (w *WAL) replay(sum uint32) error {
+	file, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]byte, len(walMagic)+4)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(walMagic)]) != walMagic {
+		return fmt.Errorf("cleo: %s is not a write-ahead log", w.path)
+	}
+	if binary.BigEndian.Uint32(header[len(walMagic):]) != sum {
+		log.Printf("cleo: discarding %s, which was written for another snapshot", w.path)
+		return nil
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	m := snapshot().update()
+	applied := 0
+	for {
+		op, words, err := readWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || err == ErrSnapshotChecksum && atEOF(r) {
+			log.Printf("cleo: ignoring torn record %d at the end of %s", applied+1, w.path)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cleo: record %d of %s: %v", applied+1, w.path, err)
+		}
+		switch op {
+		case walAdd:
+			m.addWords(words)
+		case walDelete:
+			for _, word := range words {
+				m.deleteWord(word)
+			}
+		case walCompact:
+			m = m.compacted().update()
+		default:
+			return fmt.Errorf("cleo: unknown operation %q in %s", op, w.path)
+		}
+		applied++
+	}
+	if applied > 0 {
+		publish(m)
+	}
+	return nil
+}
+
+func atEOF(r *bufio.Reader) bool {
+	_, err := r.Peek(1)
+	return err == io.EOF
+}
+
+func readWALRecord(r *bufio.Reader) (byte, []string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n == 0 || n > 64<<20 {
+		return 0, nil, ErrBadSnapshot
+	}
+	payload := make([]byte, n+4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload[:n]) != binary.BigEndian.Uint32(payload[n:]) {
+		return 0, nil, ErrSnapshotChecksum
+	}
+
+	sr := newSnapshotReader(bufio.NewReader(bytes.NewReader(payload[1:n])))
+	count := sr.uint()
+	words := make([]string, 0, Min(int(count), 1024))
+	for ; count > 0 && sr.err == nil; count-- {
+		words = append(words, sr.string())
+	}
+	return payload[0], words, sr.failed()
+}
+
+//append logs an update and syncs it to disk.  It is called holding
+//writeMu, before the update is served.
+func (w *WAL) append(op byte, words ...string) error {
+	var payload bytes.Buffer
+	pw := &snapshotWriter{w: bufio.NewWriter(&payload)}
+	pw.w.WriteByte(op)
+	pw.uint(uint64(len(words)))
+	for _, word := range words {
+		pw.string(word)
+	}
+	if pw.err == nil {
+		pw.err = pw.w.Flush()
+	}
+	if pw.err != nil {
+		return pw.err
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	record := append(buf[:binary.PutUvarint(buf[:], uint64(payload.Len()))], payload.Bytes()...)
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(payload.Bytes()))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return errors.New("cleo: WAL is closed")
+	}
+	if w.failed != nil {
+		return w.failed
+	}
+	_, err := w.file.Write(record)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		//Cut off what was written of the record, so later records are
+		//not appended after a torn one
+		if terr := w.file.Truncate(w.size); terr != nil {
+			w.failed = fmt.Errorf("cleo: WAL %s is damaged, refusing updates: %v", w.path, err)
+		}
+		return err
+	}
+	w.size += int64(len(record))
+	w.records++
+	return nil
+}
+
+//logUpdate logs an update to the open WAL, if any.
+func logUpdate(op byte, words ...string) error {
+	if journal == nil {
+		return nil
+	}
+	return journal.append(op, words...)
+}
+
+//checkpointJournal checkpoints the open WAL, if any, after the served
+//index was replaced rather than updated.  It is called holding writeMu.
+func checkpointJournal() error {
+	if journal == nil {
+		return nil
+	}
+	return journal.checkpoint()
+}
+
+//Checkpoint writes the served index to the snapshot file and starts an
+//empty log for it.
+func (w *WAL) Checkpoint() error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	return w.checkpoint()
+}
+
+//checkpoint is Checkpoint holding writeMu.  The new snapshot replaces
+//the old one before the new log replaces the old log, so a crash in
+//between leaves a log that OpenWAL discards.
+func (w *WAL) checkpoint() error {
+	m := snapshot()
+	if m == nil {
+		return ErrNoIndex
+	}
+
+	crc := crc32.NewIEEE()
+	err := writeFileAtomic(w.snapshotPath, func(f io.Writer) error {
+		return writeSnapshot(io.MultiWriter(f, crc), m)
+	})
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(w.path, func(f io.Writer) error {
+		header := append([]byte(walMagic), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(header[len(walMagic):], crc.Sum32())
+		_, err := f.Write(header)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file, w.size, w.failed, w.records = file, int64(len(walMagic)+4), nil, 0
+	w.mu.Unlock()
+	return nil
+}
+
+//CheckpointEvery checkpoints every interval while updates have been
+//logged, until the WAL is closed.
+func (w *WAL) CheckpointEvery(interval time.Duration) {
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-tick.C:
+			}
+			w.mu.Lock()
+			pending := w.records > 0
+			w.mu.Unlock()
+			if pending {
+				if err := w.Checkpoint(); err != nil {
+					log.Printf("cleo: checkpoint: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+//Close stops logging updates.  Updates logged since the last
+//checkpoint are kept, to be replayed by the next OpenWAL.
+func (w *WAL) Close() error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	if journal == w {
+		journal = nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	close(w.stop)
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+//writeFileAtomic writes a file by writing and syncing a temporary file
+//next to it, renaming that over it and syncing the directory.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	err = tmp.Chmod(0644) //CreateTemp makes it private
+	if err == nil {
+		err = write(bw)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	//Sync the directory too, so the rename is durable before the caller
+	//goes on
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if cerr := dir.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func fileChecksum(path string) (uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	crc := crc32.NewIEEE()
+	_, err = io.Copy(crc, file)
+	return crc.Sum32(), err
+}